@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// awsCallOptions holds the retry and timeout settings applied to every aws CLI
+// call made for one resource, and the provider instance it runs for.
+type awsCallOptions struct {
+	maxRetries int
+	apiTimeout time.Duration
+	config     *Config
+}
+
+// resourceGetter is implemented by both schema.ResourceData and schema.ResourceDiff.
+type resourceGetter interface {
+	Get(key string) interface{}
+}
+
+// getAWSCallOptions merges the resource settings over the provider defaults,
+// zero values on the resource inherit from the provider.
+func getAWSCallOptions(d resourceGetter, config *Config) awsCallOptions {
+	opts := config.defaultAWSCallOptions()
+	if maxRetries := d.Get("max_retries").(int); maxRetries > 0 {
+		opts.maxRetries = maxRetries
+	}
+	if apiTimeout := d.Get("api_timeout").(string); apiTimeout != "" {
+		opts.apiTimeout, _ = time.ParseDuration(apiTimeout)
+	}
+	return opts
+}
+
+func (c *Config) defaultAWSCallOptions() awsCallOptions {
+	return awsCallOptions{
+		maxRetries: c.maxRetries,
+		apiTimeout: c.apiTimeout,
+		config:     c,
+	}
+}
+
+// command prepares an aws CLI invocation, the returned cancel func must be
+// called once the command finished.
+func (o awsCallOptions) command(name string, args ...string) (*exec.Cmd, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if o.apiTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.apiTimeout)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Commands run through bash, so give the aws child a moment to release the output pipes
+	cmd.WaitDelay = time.Second
+	cmd.Env = o.environ()
+	if o.maxRetries > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("AWS_MAX_ATTEMPTS=%d", o.maxRetries+1))
+	}
+	return cmd, cancel
+}
+
+// toolCommand prepares a docker or helm invocation, which needs the provider
+// environment as well but runs as long as the build or push takes.
+func (o awsCallOptions) toolCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Env = o.environ()
+	return cmd
+}
+
+func (o awsCallOptions) environ() []string {
+	if o.config == nil {
+		return os.Environ()
+	}
+	return o.config.environ()
+}
+
+func (o awsCallOptions) caBundlePath() string {
+	if o.config == nil {
+		return ""
+	}
+	return o.config.caBundlePath
+}
+
+// mergeEnv sets the KEY=value overrides on the environment, an override with
+// an empty value removes the variable.
+func mergeEnv(env []string, overrides ...string) []string {
+	merged := []string{}
+	overridden := map[string]bool{}
+	for _, override := range overrides {
+		overridden[strings.SplitN(override, "=", 2)[0]] = true
+	}
+	for _, variable := range env {
+		if overridden[strings.SplitN(variable, "=", 2)[0]] != true {
+			merged = append(merged, variable)
+		}
+	}
+	for _, override := range overrides {
+		if strings.HasSuffix(override, "=") != true {
+			merged = append(merged, override)
+		}
+	}
+	return merged
+}
+
+func validateDuration(v interface{}, k string) ([]string, []error) {
+	if _, err := time.ParseDuration(v.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%q must be a duration like 30s or 2m: %v", k, err)}
+	}
+	return nil, nil
+}
+
+// newHTTPClient returns the client for requests the provider makes itself. It
+// trusts the certificates of the ca_bundle_path like the aws CLI does, on top
+// of the system pool.
+func newHTTPClient(timeout time.Duration, caBundlePath string) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if caBundlePath == "" {
+		return client, nil
+	}
+	caBundle, err := os.ReadFile(caBundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA bundle %s: %v", caBundlePath, err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if rootCAs.AppendCertsFromPEM(caBundle) != true {
+		return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", caBundlePath)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	client.Transport = transport
+	return client, nil
+}
+
+// Locations of the system certificate bundle, as searched by crypto/x509.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// combineCABundle writes the system certificates followed by the ones of
+// caBundlePath to a temporary file for AWS_CA_BUNDLE. The file lives as long
+// as the provider process.
+func combineCABundle(caBundlePath string) (string, error) {
+	caBundle, err := os.ReadFile(caBundlePath)
+	if err != nil {
+		return "", err
+	}
+	systemBundles := systemCABundles
+	if certFile := os.Getenv("SSL_CERT_FILE"); certFile != "" {
+		systemBundles = []string{certFile}
+	}
+	var systemBundle []byte
+	for _, path := range systemBundles {
+		if systemBundle, err = os.ReadFile(path); err == nil {
+			break
+		}
+	}
+	if systemBundle == nil {
+		log.Printf("[WARN] No system certificate bundle found, the aws CLI only trusts %s", caBundlePath)
+	}
+	combined, err := os.CreateTemp("", "ca-bundle-*.pem")
+	if err != nil {
+		return "", err
+	}
+	defer combined.Close()
+	if _, err := combined.Write(append(append(systemBundle, '\n'), caBundle...)); err != nil {
+		return "", err
+	}
+	return combined.Name(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveBuildContext writes the context directory to a tar archive, which is
+// sent instead of the directory since the docker CLI cannot apply
+// exclude_patterns or include_patterns. The Dockerfile and .dockerignore are
+// always included. It returns the archive and the Dockerfile path inside it.
+func archiveBuildContext(contextPath, dockerfile string, extraPatterns, includePatterns []string) (string, string, error) {
+	archive, err := os.CreateTemp("", "build-context-*.tar")
+	if err != nil {
+		return "", "", err
+	}
+	defer archive.Close()
+
+	dockerfileInArchive := getDockerfileInContext(contextPath, dockerfile)
+	if dockerfileInArchive != "" {
+		extraPatterns = append(extraPatterns, "!"+dockerfileInArchive)
+	}
+	extraPatterns = append(extraPatterns, "!.dockerignore")
+	includePatterns = getContextIncludePatterns(includePatterns, dockerfileInArchive)
+
+	tarWriter := tar.NewWriter(archive)
+	err = walkBuildContext(contextPath, extraPatterns, includePatterns, func(path, relPath string, entry fs.DirEntry) error {
+		return addToArchive(tarWriter, path, relPath)
+	})
+	if err == nil && dockerfile != "" && strings.HasPrefix(dockerfileInArchive, ".dockerfile.") {
+		err = addToArchive(tarWriter, dockerfile, dockerfileInArchive)
+	}
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err != nil {
+		os.Remove(archive.Name())
+		return "", "", err
+	}
+	return archive.Name(), dockerfileInArchive, nil
+}
+
+// getDockerfileInContext returns the path of the Dockerfile inside the
+// context, a Dockerfile outside of it gets a generated name.
+func getDockerfileInContext(contextPath, dockerfile string) string {
+	if dockerfile == "" {
+		return ""
+	}
+	relPath, err := filepath.Rel(contextPath, dockerfile)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		relPath = ".dockerfile." + filepath.Base(dockerfile)
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// getContextIncludePatterns adds the Dockerfile and .dockerignore to the
+// include_patterns, the archive and the content hash use the same list.
+func getContextIncludePatterns(includePatterns []string, dockerfileInContext string) []string {
+	if len(includePatterns) == 0 {
+		return nil
+	}
+	contextPatterns := append([]string{}, includePatterns...)
+	contextPatterns = append(contextPatterns, "Dockerfile", ".dockerignore")
+	if dockerfileInContext != "" {
+		contextPatterns = append(contextPatterns, dockerfileInContext)
+	}
+	return contextPatterns
+}
+
+func addToArchive(tarWriter *tar.Writer, path, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() != true {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// buildError describes a failed docker build. Its message is JSON so CI
+// tooling can pick out the failing instruction.
+type buildError struct {
+	Step           string `json:"step,omitempty"`
+	Instruction    string `json:"instruction,omitempty"`
+	DockerfileLine int    `json:"dockerfile_line,omitempty"`
+	ExitCode       int    `json:"exit_code,omitempty"`
+	Message        string `json:"message"`
+}
+
+func (e *buildError) Error() string {
+	detail, _ := json.Marshal(e)
+	return "Docker build failed: " + string(detail)
+}
+
+var (
+	// Classic builder: "Step 3/7 : RUN make" and "The command '/bin/sh -c make' returned a non-zero code: 2"
+	classicStepRegexp     = regexp.MustCompile(`(?m)^Step (\d+/\d+) : (.*)$`)
+	classicExitCodeRegexp = regexp.MustCompile(`returned a non-zero code: (\d+)`)
+	classicErrorRegexp    = regexp.MustCompile(`(?m)^(The command .*returned a non-zero code: \d+)$`)
+	// BuildKit: "#8 [3/5] RUN make", "prod.Dockerfile:12" with the base name of the Dockerfile
+	// and "did not complete successfully: exit code: 2"
+	buildkitStepRegexp     = regexp.MustCompile(`(?m)^#\d+ \[[^\]]*?(\d+/\d+)\] (.*)$`)
+	buildkitLineRegexp     = regexp.MustCompile(`(?m)^(\S+):(\d+)$`)
+	buildkitExitCodeRegexp = regexp.MustCompile(`exit code: (\d+)`)
+	buildkitErrorRegexp    = regexp.MustCompile(`(?m)^ERROR: (.*)$`)
+)
+
+// parseBuildError extracts the failing step, Dockerfile line and exit code
+// from the output of a failed docker build.
+func parseBuildError(out []byte, err error) *buildError {
+	output := string(out)
+	detail := &buildError{Message: err.Error()}
+	if match := lastSubmatch(classicStepRegexp, output); match != nil {
+		detail.Step, detail.Instruction = match[1], strings.TrimSpace(match[2])
+	}
+	if match := lastSubmatch(buildkitStepRegexp, output); match != nil {
+		detail.Step, detail.Instruction = match[1], strings.TrimSpace(match[2])
+	}
+	if match := lastSubmatch(buildkitLineRegexp, output); match != nil {
+		detail.DockerfileLine, _ = strconv.Atoi(match[2])
+	}
+	for _, exitCodeRegexp := range []*regexp.Regexp{classicExitCodeRegexp, buildkitExitCodeRegexp} {
+		if match := lastSubmatch(exitCodeRegexp, output); match != nil {
+			detail.ExitCode, _ = strconv.Atoi(match[1])
+		}
+	}
+	for _, errorRegexp := range []*regexp.Regexp{classicErrorRegexp, buildkitErrorRegexp} {
+		if match := lastSubmatch(errorRegexp, output); match != nil {
+			detail.Message = strings.TrimSpace(match[1])
+		}
+	}
+	return detail
+}
+
+func lastSubmatch(re *regexp.Regexp, output string) []string {
+	matches := re.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches[len(matches)-1]
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseBuildErrorDockerfileLine(t *testing.T) {
+	for dockerfile, output := range map[string]string{
+		"Dockerfile":      "#8 [3/5] RUN make\n#8 ERROR: process \"/bin/sh -c make\" did not complete successfully: exit code: 2\n--------------------\nDockerfile:12\n--------------------\nERROR: failed to solve: process \"/bin/sh -c make\" did not complete successfully: exit code: 2\n",
+		"prod.Dockerfile": "#8 [3/5] RUN make\n--------------------\nprod.Dockerfile:12\n--------------------\nERROR: failed to solve: process \"/bin/sh -c make\" did not complete successfully: exit code: 2\n",
+		"Dockerfile.dev":  "#8 [3/5] RUN make\n--------------------\nDockerfile.dev:12\n--------------------\nERROR: failed to solve: process \"/bin/sh -c make\" did not complete successfully: exit code: 2\n",
+	} {
+		detail := parseBuildError([]byte(output), errors.New("exit status 1"))
+		if detail.DockerfileLine != 12 {
+			t.Errorf("%s: expected line 12, got %d", dockerfile, detail.DockerfileLine)
+		}
+		if detail.Step != "3/5" || detail.Instruction != "RUN make" || detail.ExitCode != 2 {
+			t.Errorf("%s: unexpected detail %+v", dockerfile, detail)
+		}
+	}
+}
+
+func TestParseBuildErrorClassic(t *testing.T) {
+	output := "Step 3/7 : RUN make\n ---> Running in 0123456789ab\nThe command '/bin/sh -c make' returned a non-zero code: 2\n"
+	detail := parseBuildError([]byte(output), errors.New("exit status 1"))
+	expected := buildError{Step: "3/7", Instruction: "RUN make", ExitCode: 2, Message: "The command '/bin/sh -c make' returned a non-zero code: 2"}
+	if *detail != expected {
+		t.Errorf("expected %+v, got %+v", expected, *detail)
+	}
+}
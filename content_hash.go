@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// getContentHash combines every input that determines the image content: the
+// build context and Dockerfile, the context tarball, or the S3 context
+// revision, the builder and ulimits, the annotations, the provenance mode and
+// the build settings of all variants. Flags for the cache, intermediate
+// containers, extra hosts and proxies do not change the image and are left out.
+func getContentHash(d resourceGetter, contextRevision string) (string, error) {
+	contentHash := sha256.New()
+	if contextS3Uri := d.Get("context_s3_uri").(string); contextS3Uri != "" {
+		fmt.Fprintf(contentHash, "context_s3 %s %s\n", contextS3Uri, contextRevision)
+	} else if contextTarballPath := d.Get("context_tarball_path").(string); contextTarballPath != "" {
+		fileHash, err := hashFile(contextTarballPath)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(contentHash, "context_tarball %s\n", fileHash)
+	} else {
+		contextPath, dockerfile := getBuildContext(d)
+		normalizeDockerfile := d.Get("normalize_dockerfile_hash").(bool)
+		normalizedFile := ""
+		if normalizeDockerfile {
+			normalizedFile = "Dockerfile"
+			if dockerfile != "" {
+				normalizedFile, _ = filepath.Rel(contextPath, dockerfile)
+				normalizedFile = filepath.ToSlash(normalizedFile)
+			}
+		}
+		includePatterns := getContextIncludePatterns(getIncludePatterns(d), getDockerfileInContext(contextPath, dockerfile))
+		err := hashBuildContext(contentHash, contextPath, getExcludePatterns(d), includePatterns, normalizedFile)
+		if err != nil {
+			return "", err
+		}
+		if dockerfile != "" {
+			fileHash, err := hashDockerfile(dockerfile, normalizeDockerfile)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(contentHash, "dockerfile %s\n", fileHash)
+		}
+		if dockerfileContent := d.Get("dockerfile_content").(string); dockerfileContent != "" {
+			if normalizeDockerfile {
+				dockerfileContent = string(normalizeDockerfileContent([]byte(dockerfileContent)))
+			}
+			fmt.Fprintf(contentHash, "dockerfile_content %x\n", sha256.Sum256([]byte(dockerfileContent)))
+		}
+	}
+	if bakeFile := d.Get("bake_file").(string); bakeFile != "" {
+		fileHash, err := hashFile(bakeFile)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(contentHash, "bake %s %s\n", fileHash, d.Get("bake_target").(string))
+	}
+	if builder := d.Get("builder").(string); builder != "" {
+		fmt.Fprintf(contentHash, "builder %s\n", builder)
+	}
+	if ulimitFlags := getUlimitFlags(d); len(ulimitFlags) > 0 {
+		fmt.Fprintf(contentHash, "ulimits %q\n", ulimitFlags)
+	}
+	if annotationFlags := getAnnotationFlags(d); len(annotationFlags) > 0 {
+		fmt.Fprintf(contentHash, "annotations %q\n", annotationFlags)
+	}
+	if provenance := d.Get("provenance").(string); provenance != "false" {
+		fmt.Fprintf(contentHash, "provenance %s\n", provenance)
+	}
+	for _, raw := range d.Get("variants").([]interface{}) {
+		variant := raw.(map[string]interface{})
+		fmt.Fprintf(contentHash, "variant %s %q\n", variant["tag"], getVariantBuildFlags(variant))
+	}
+	return hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+// hashBuildContext hashes the path and content of every file docker would
+// send as build context, skipping the entries excluded by .dockerignore and
+// exclude_patterns, or not matched by include_patterns. The Dockerfile at
+// normalizedFile is hashed normalized.
+func hashBuildContext(contentHash hash.Hash, contextPath string, extraPatterns, includePatterns []string, normalizedFile string) error {
+	return walkBuildContext(contextPath, extraPatterns, includePatterns, func(path, relPath string, entry fs.DirEntry) error {
+		if ignoredByTerraform(relPath) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case entry.IsDir():
+			return nil
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(contentHash, "symlink %s %s\n", relPath, target)
+		default:
+			fileHash, err := hashDockerfile(path, relPath == normalizedFile)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(contentHash, "file %s %s\n", relPath, fileHash)
+		}
+		return nil
+	})
+}
+
+// walkBuildContext calls walkFn for every entry of the context directory that
+// is not excluded by .dockerignore or the extra patterns, which apply after
+// the .dockerignore entries. With include patterns only the entries matching
+// one of them, or inside a matching directory, are passed on.
+func walkBuildContext(contextPath string, extraPatterns, includePatterns []string, walkFn func(path, relPath string, entry fs.DirEntry) error) error {
+	excludePatterns, err := readDockerignore(contextPath)
+	if err != nil {
+		return err
+	}
+	excludePatterns = append(excludePatterns, extraPatterns...)
+	return filepath.WalkDir(contextPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(contextPath, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if matchesExcludePatterns(relPath, excludePatterns) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Directories are still walked for the included entries below them
+		if len(includePatterns) > 0 && matchesIncludePatterns(relPath, includePatterns) != true {
+			return nil
+		}
+		return walkFn(path, relPath, entry)
+	})
+}
+
+func getExcludePatterns(d resourceGetter) []string {
+	var excludePatterns []string
+	for _, pattern := range d.Get("exclude_patterns").([]interface{}) {
+		excludePatterns = append(excludePatterns, pattern.(string))
+	}
+	return excludePatterns
+}
+
+func getIncludePatterns(d resourceGetter) []string {
+	var includePatterns []string
+	for _, pattern := range d.Get("include_patterns").([]interface{}) {
+		includePatterns = append(includePatterns, pattern.(string))
+	}
+	return includePatterns
+}
+
+// ignoredByTerraform skips the working files terraform writes next to the
+// configuration, so a context of "." does not change on every apply.
+func ignoredByTerraform(relPath string) bool {
+	return relPath == ".terraform" || strings.HasPrefix(relPath, ".terraform/") || strings.Contains(filepath.Base(relPath), ".tfstate")
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
+}
+
+// hashDockerfile hashes the raw bytes of the file, or with normalize the
+// content with LF line endings and without trailing whitespace, so a checkout
+// on another OS does not change the hash.
+func hashDockerfile(path string, normalize bool) (string, error) {
+	if normalize != true {
+		return hashFile(path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(normalizeDockerfileContent(content))), nil
+}
+
+func normalizeDockerfileContent(content []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n"))
+}
+
+func readDockerignore(contextPath string) ([]string, error) {
+	file, err := os.Open(filepath.Join(contextPath, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// matchesExcludePatterns applies .dockerignore style patterns to a slash
+// separated path. A pattern also excludes everything below a matching
+// directory and later patterns starting with ! re-include paths.
+func matchesExcludePatterns(relPath string, patterns []string) bool {
+	excluded := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(strings.TrimPrefix(pattern, "!"))), "/")
+		if matchesPathOrParent(pattern, relPath) {
+			excluded = !negate
+		}
+	}
+	return excluded
+}
+
+func matchesIncludePatterns(relPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(pattern)), "/")
+		if matchesPathOrParent(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPathOrParent(pattern, relPath string) bool {
+	patternRegexp := compilePattern(pattern)
+	if patternRegexp == nil {
+		return false
+	}
+	for path := relPath; path != "."; path = filepath.ToSlash(filepath.Dir(path)) {
+		if patternRegexp.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+var compiledPatterns sync.Map
+
+// compilePattern turns a pattern into a regexp the way Docker's patternmatcher
+// does: * and ? stay within one path segment, ** spans any number of them,
+// including none, and \ escapes the next character. An invalid pattern, like
+// an unclosed character class, returns nil and matches nothing.
+func compilePattern(pattern string) *regexp.Regexp {
+	if cached, found := compiledPatterns.Load(pattern); found {
+		return cached.(*regexp.Regexp)
+	}
+	regStr := "^"
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch ch := runes[i]; {
+		case ch == '*' && i+1 < len(runes) && runes[i+1] == '*':
+			i++
+			// **/ is treated as **
+			if i+1 < len(runes) && runes[i+1] == '/' {
+				i++
+			}
+			if i+1 == len(runes) {
+				regStr += ".*"
+			} else {
+				regStr += "(.*/)?"
+			}
+		case ch == '*':
+			regStr += "[^/]*"
+		case ch == '?':
+			regStr += "[^/]"
+		case strings.ContainsRune(".+()|{}$", ch):
+			regStr += `\` + string(ch)
+		case ch == '\\' && i+1 < len(runes):
+			i++
+			regStr += regexp.QuoteMeta(string(runes[i]))
+		case ch == '\\':
+			regStr += `\\`
+		default:
+			regStr += string(ch)
+		}
+	}
+	patternRegexp, err := regexp.Compile(regStr + "$")
+	if err != nil {
+		patternRegexp = nil
+	}
+	compiledPatterns.Store(pattern, patternRegexp)
+	return patternRegexp
+}
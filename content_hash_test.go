@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchesExcludePatterns(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		relPath  string
+		expected bool
+	}{
+		{[]string{"*.log"}, "app.log", true},
+		{[]string{"*.log"}, "logs/app.log", false},
+		{[]string{"**/*.log"}, "app.log", true},
+		{[]string{"**/*.log"}, "logs/2024/app.log", true},
+		{[]string{"docs/**/*.md"}, "docs/readme.md", true},
+		{[]string{"docs/**/*.md"}, "docs/api/v1/readme.md", true},
+		{[]string{"docs/**/*.md"}, "src/readme.md", false},
+		{[]string{"node_modules/**"}, "node_modules/lib/index.js", true},
+		{[]string{"**"}, "any/path", true},
+		{[]string{"build"}, "build/out/app", true},
+		{[]string{"/build"}, "build/out/app", true},
+		{[]string{"build"}, "src/build", false},
+		{[]string{"?.txt"}, "a.txt", true},
+		{[]string{"?.txt"}, "ab.txt", false},
+		{[]string{"[ab].txt"}, "b.txt", true},
+		{[]string{"a.b"}, "axb", false},
+		{[]string{`\*.txt`}, "*.txt", true},
+		{[]string{`\*.txt`}, "a.txt", false},
+		{[]string{"[a-"}, "[a-", false},
+		{[]string{"*.md", "!README.md"}, "README.md", false},
+		{[]string{"*.md", "!README.md"}, "CHANGES.md", true},
+		{[]string{"docs", "!docs/keep.md"}, "docs/keep.md", false},
+		{[]string{"!README.md", "*.md"}, "README.md", true},
+		{[]string{"**/*.tmp", "!**/keep/*.tmp"}, "a/keep/b.tmp", false},
+	} {
+		if matched := matchesExcludePatterns(test.relPath, test.patterns); matched != test.expected {
+			t.Errorf("%q against %q: expected %v, got %v", test.relPath, test.patterns, test.expected, matched)
+		}
+	}
+}
+
+func TestMatchesIncludePatterns(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		relPath  string
+		expected bool
+	}{
+		{[]string{"src"}, "src/main.go", true},
+		{[]string{"src/**/*.go"}, "src/cmd/app/main.go", true},
+		{[]string{"src/**/*.go"}, "src/cmd/app/main.c", false},
+		{[]string{"*.go"}, "main.go", true},
+		{[]string{"*.go"}, "cmd/main.go", false},
+	} {
+		if matched := matchesIncludePatterns(test.relPath, test.patterns); matched != test.expected {
+			t.Errorf("%q against %q: expected %v, got %v", test.relPath, test.patterns, test.expected, matched)
+		}
+	}
+}
+
+func TestGetContentHashBuildFlags(t *testing.T) {
+	contextPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextPath, "Dockerfile"), []byte("FROM alpine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	getHash := func(key string, value interface{}) string {
+		d := ResourcePushImage().TestResourceData()
+		d.Set("dockerfile_path", contextPath)
+		if key != "" {
+			d.Set(key, value)
+		}
+		contentHash, err := getContentHash(d, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contentHash
+	}
+	baseHash := getHash("", nil)
+	for key, value := range map[string]interface{}{
+		"keep_intermediate": true,
+		"cache_from":        []interface{}{"registry.example.com/service:cache"},
+		"extra_hosts":       []interface{}{"db:10.0.0.2"},
+		"proxy_build_args":  true,
+	} {
+		if getHash(key, value) != baseHash {
+			t.Errorf("expected %s to leave the content hash unchanged", key)
+		}
+	}
+	for key, value := range map[string]interface{}{
+		"build_ulimits": []interface{}{map[string]interface{}{"name": "nofile", "soft": 1024, "hard": 2048}},
+		"builder":       "remote",
+	} {
+		if getHash(key, value) == baseHash {
+			t.Errorf("expected %s to change the content hash", key)
+		}
+	}
+}
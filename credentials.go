@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+// credentialsSource hands out the credentials every aws CLI call of one
+// provider instance runs with, so all calls for ECR and STS use the same final
+// identity. Temporary credentials are fetched again before they expire.
+type credentialsSource struct {
+	mutex      sync.Mutex
+	fetch      func() ([]string, time.Time, error)
+	env        []string
+	expiration time.Time
+}
+
+// Temporary credentials are renewed while a push started with them still has
+// time to finish.
+const credentialsRefreshMargin = 15 * time.Minute
+
+func (s *credentialsSource) environ() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.env != nil && (s.expiration.IsZero() || time.Until(s.expiration) > credentialsRefreshMargin) {
+		return s.env, nil
+	}
+	env, expiration, err := s.fetch()
+	if err != nil {
+		return nil, err
+	}
+	s.env, s.expiration = env, expiration
+	return env, nil
+}
+
+// configureCredentials sets up the credentials source of the provider, static
+// keys, a profile, the container credentials and a role assumed with them.
+func configureCredentials(d *schema.ResourceData, config *Config) error {
+	accessKey := d.Get("access_key").(string)
+	secretKey := d.Get("secret_key").(string)
+	sourceProfile := d.Get("source_profile").(string)
+	roleArn := d.Get("role_arn").(string)
+
+	if (accessKey == "") != (secretKey == "") {
+		return errors.New("access_key and secret_key must be set together")
+	}
+	if accessKey != "" && (sourceProfile != "" || roleArn != "") {
+		return errors.New("Static credentials (access_key, secret_key) cannot be combined with source_profile or role_arn")
+	}
+
+	var sourceCredentials *credentialsSource
+	if d.Get("use_container_credentials").(bool) {
+		sourceCredentials = &credentialsSource{fetch: func() ([]string, time.Time, error) {
+			return fetchContainerCredentials(config.caBundlePath)
+		}}
+	}
+	if accessKey != "" {
+		sourceCredentials = &credentialsSource{fetch: func() ([]string, time.Time, error) {
+			return []string{"AWS_ACCESS_KEY_ID=" + accessKey, "AWS_SECRET_ACCESS_KEY=" + secretKey, "AWS_SESSION_TOKEN=", "AWS_PROFILE="}, time.Time{}, nil
+		}}
+	} else if sourceProfile != "" && sourceCredentials == nil {
+		sourceCredentials = &credentialsSource{fetch: func() ([]string, time.Time, error) {
+			return []string{"AWS_PROFILE=" + sourceProfile}, time.Time{}, nil
+		}}
+	}
+	if roleArn == "" {
+		config.credentials = sourceCredentials
+		return nil
+	}
+
+	// The role is assumed with the source profile or the container
+	// credentials, the session credentials then replace any profile
+	cmdArgs := []string{"sts", "assume-role", "--role-arn", roleArn, "--role-session-name", d.Get("role_session_name").(string), "--query", "Credentials", "--output", "json"}
+	if sourceProfile != "" {
+		cmdArgs = append(cmdArgs, "--profile", sourceProfile)
+	}
+	if credentialsRegion := d.Get("credentials_region").(string); credentialsRegion != "" {
+		cmdArgs = append(cmdArgs, "--region", credentialsRegion)
+	}
+	config.credentials = &credentialsSource{fetch: func() ([]string, time.Time, error) {
+		env := mergeEnv(os.Environ(), config.env...)
+		if sourceCredentials != nil {
+			sourceEnv, err := sourceCredentials.environ()
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			env = mergeEnv(env, sourceEnv...)
+		}
+		assumeRole := exec.Command("aws", cmdArgs...)
+		assumeRole.Env = env
+		out, err := assumeRole.CombinedOutput()
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("Error assuming role %s: %v: %s", roleArn, err, out)
+		}
+		var credentials struct {
+			AccessKeyId     string    `json:"AccessKeyId"`
+			SecretAccessKey string    `json:"SecretAccessKey"`
+			SessionToken    string    `json:"SessionToken"`
+			Expiration      time.Time `json:"Expiration"`
+		}
+		if err := json.Unmarshal(out, &credentials); err != nil {
+			return nil, time.Time{}, err
+		}
+		return []string{"AWS_ACCESS_KEY_ID=" + credentials.AccessKeyId, "AWS_SECRET_ACCESS_KEY=" + credentials.SecretAccessKey, "AWS_SESSION_TOKEN=" + credentials.SessionToken, "AWS_PROFILE="}, credentials.Expiration, nil
+	}}
+	return nil
+}
+
+// fetchContainerCredentials fetches the credentials of the ECS task or
+// CodeBuild project from the container credentials endpoint, so no shared
+// config or profile earlier in the chain of the aws CLI wins. An assumed
+// role_arn then uses them as source credentials.
+func fetchContainerCredentials(caBundlePath string) ([]string, time.Time, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relativeUri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeUri != "" {
+		endpoint = "http://169.254.170.2" + relativeUri
+	}
+	if endpoint == "" {
+		return nil, time.Time{}, errors.New("use_container_credentials is set but neither AWS_CONTAINER_CREDENTIALS_RELATIVE_URI nor AWS_CONTAINER_CREDENTIALS_FULL_URI is")
+	}
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	authorization := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("Error reading the container authorization token: %v", err)
+		}
+		authorization = strings.TrimSpace(string(token))
+	}
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	client, err := newHTTPClient(10*time.Second, caBundlePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("Error requesting container credentials: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("Error requesting container credentials: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	var credentials struct {
+		AccessKeyId     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		return nil, time.Time{}, err
+	}
+	return []string{"AWS_ACCESS_KEY_ID=" + credentials.AccessKeyId, "AWS_SECRET_ACCESS_KEY=" + credentials.SecretAccessKey, "AWS_SESSION_TOKEN=" + credentials.Token, "AWS_PROFILE="}, credentials.Expiration, nil
+}
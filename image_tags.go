@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+)
+
+// DataSourceImageTags lists the tags of an ECR repository matching a pattern,
+// for example all tags of a version with a commit suffix.
+func DataSourceImageTags() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceImageTagsRead,
+		Schema: map[string]*schema.Schema{
+			"ecr_repository_name": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validation.StringMatch(repositoryNameRegexp, "must be a valid ECR repository name"),
+			},
+			"aws_region": {
+				Type:        schema.TypeString,
+				Required:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"AWS_REGION", "AWS_DEFAULT_REGION"}, nil),
+			},
+			"pattern": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			// glob supports * as wildcard, the same as the tag mutability exclusion filters
+			"match_mode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "prefix",
+				ValidateFunc: validation.StringInSlice([]string{"exact", "prefix", "suffix", "glob"}, false),
+			},
+			"tags": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+func dataSourceImageTagsRead(d *schema.ResourceData, meta interface{}) error {
+	opts := meta.(*Config).defaultAWSCallOptions()
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+	pattern := d.Get("pattern").(string)
+	matchMode := d.Get("match_mode").(string)
+
+	tags, err := getMatchingTags(opts, pattern, matchMode, repoName, awsRegion)
+	if err != nil {
+		log.Fatal("Error listing image tags: ", err)
+	}
+	d.SetId(fmt.Sprintf("%s/%s:%s:%s", awsRegion, repoName, matchMode, pattern))
+	d.Set("tags", tags)
+	return nil
+}
+
+// getMatchingTags returns the sorted tags of the repository matching the pattern.
+func getMatchingTags(opts awsCallOptions, pattern, matchMode, repoName, awsRegion string) ([]string, error) {
+	imageIds, err := listImageIds(opts, repoName, tagStatusTagged, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, id := range imageIds {
+		if tagMatches(id.ImageTag, pattern, matchMode) {
+			tags = append(tags, id.ImageTag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func tagMatches(imageTag, pattern, matchMode string) bool {
+	switch matchMode {
+	case "prefix":
+		return strings.HasPrefix(imageTag, pattern)
+	case "suffix":
+		return strings.HasSuffix(imageTag, pattern)
+	case "glob":
+		return matchTagFilter(pattern, imageTag)
+	}
+	return imageTag == pattern
+}
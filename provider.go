@@ -1,13 +1,259 @@
 package main
 
 import (
+    "fmt"
+    "log"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+
     "github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+    "github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 )
 
 func Provider() *schema.Provider {
     return &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			"max_concurrent_pushes": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"credentials_region": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"max_retries": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"api_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateDuration,
+			},
+			"expected_account_id": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[0-9]{12}$`), "must be a 12 digit AWS account Id"),
+			},
+			"access_key": {
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			"secret_key": {
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			// The aws CLI reads a single credentials and config file
+			"shared_credentials_files": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"shared_config_files": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			// Take the credentials from the ECS / CodeBuild container credentials endpoint
+			"use_container_credentials": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				Default:       false,
+				ConflictsWith: []string{"access_key", "source_profile"},
+			},
+			"source_profile": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"role_arn": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"role_session_name": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "terraform-ecr-push-image",
+			},
+			// Push target like {account}.dkr.ecr.{region}.vpce.example.com/{repo}:{tag}
+			"uri_template": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[^/]+/.*\{tag\}`), "must contain a registry host followed by a path with the {tag} placeholder"),
+			},
+			"use_dualstack_endpoint": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"docker_api_version": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[0-9]+\.[0-9]+$`), "must be an API version like 1.43"),
+			},
+			"lightweight_read": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			// PEM certificates trusted in addition to the system ones, e.g. of a TLS inspecting proxy
+			"ca_bundle_path": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"http_proxy": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"https_proxy": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"no_proxy": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+		},
 		ResourcesMap: map[string]*schema.Resource{
 			"aws_ecr_push_image" : ResourcePushImage(),
+			"aws_ecr_push_chart" : ResourcePushChart(),
+			"aws_ecr_push_images" : ResourcePushImages(),
+			"aws_ecr_prune_images" : ResourcePruneImages(),
+		},
+		DataSourcesMap: map[string]*schema.Resource{
+			"aws_ecr_image_tags" : DataSourceImageTags(),
+			"aws_ecr_registry_scanning_configuration" : DataSourceRegistryScanningConfiguration(),
 		},
+		ConfigureFunc: providerConfigure,
+	}
+}
+
+// Config is the provider meta shared by all resources of one provider instance.
+type Config struct {
+	// Limits the number of images pushed at the same time, nil means unlimited
+	pushSemaphore chan struct{}
+	// Region used for STS calls, empty means the region of the resource
+	credentialsRegion string
+	httpProxy         string
+	httpsProxy        string
+	noProxy           string
+	// Credentials of any other account fail the apply
+	expectedAccountId string
+	// Overrides the push target built from the repository URI
+	uriTemplate string
+	// Push to the IPv6 capable registry endpoints
+	useDualstackEndpoint bool
+	// Refresh only checks that the tag exists
+	lightweightRead bool
+	// Defaults for aws CLI calls, zero leaves the CLI defaults in place
+	maxRetries int
+	apiTimeout time.Duration
+	// Extra CA certificates of ca_bundle_path
+	caBundlePath string
+	// KEY=value settings of this provider for the aws, docker and helm CLIs
+	env         []string
+	credentials *credentialsSource
+}
+
+func providerConfigure(d *schema.ResourceData) (interface{}, error) {
+	config := &Config{
+		credentialsRegion:    d.Get("credentials_region").(string),
+		expectedAccountId:    d.Get("expected_account_id").(string),
+		httpProxy:            d.Get("http_proxy").(string),
+		httpsProxy:           d.Get("https_proxy").(string),
+		noProxy:              d.Get("no_proxy").(string),
+		maxRetries:           d.Get("max_retries").(int),
+		useDualstackEndpoint: d.Get("use_dualstack_endpoint").(bool),
+		lightweightRead:      d.Get("lightweight_read").(bool),
+		uriTemplate:          d.Get("uri_template").(string),
+	}
+	if apiTimeout := d.Get("api_timeout").(string); apiTimeout != "" {
+		config.apiTimeout, _ = time.ParseDuration(apiTimeout)
+	}
+	// The settings are passed to every aws and docker CLI call instead of the
+	// process environment, which aliased provider instances share. Registry
+	// uploads are made by the Docker daemon and use its own proxy configuration.
+	config.env = append(config.env, proxyEnv("HTTP_PROXY", config.httpProxy)...)
+	config.env = append(config.env, proxyEnv("HTTPS_PROXY", config.httpsProxy)...)
+	config.env = append(config.env, proxyEnv("NO_PROXY", config.noProxy)...)
+	if config.useDualstackEndpoint {
+		config.env = append(config.env, "AWS_USE_DUALSTACK_ENDPOINT=true")
+	}
+	// A pinned API version makes the docker CLI skip the version negotiation with the daemon
+	if dockerAPIVersion := d.Get("docker_api_version").(string); dockerAPIVersion != "" {
+		config.env = append(config.env, "DOCKER_API_VERSION="+dockerAPIVersion)
+	}
+	if files := d.Get("shared_credentials_files").([]interface{}); len(files) > 0 {
+		config.env = append(config.env, "AWS_SHARED_CREDENTIALS_FILE="+files[0].(string))
+	}
+	if files := d.Get("shared_config_files").([]interface{}); len(files) > 0 {
+		config.env = append(config.env, "AWS_CONFIG_FILE="+files[0].(string))
+	}
+	// The aws CLI only trusts the AWS_CA_BUNDLE it is given, so it gets the
+	// system certificates together with the extra ones. newHTTPClient adds them
+	// to the system pool itself. The Docker daemon verifies registries against
+	// its own certs.d directory.
+	if caBundlePath := d.Get("ca_bundle_path").(string); caBundlePath != "" {
+		combinedBundle, err := combineCABundle(caBundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading ca_bundle_path: %v", err)
+		}
+		config.caBundlePath = caBundlePath
+		config.env = append(config.env, "AWS_CA_BUNDLE="+combinedBundle)
+	}
+	if err := configureCredentials(d, config); err != nil {
+		return nil, err
+	}
+	// Fails the configuration instead of the first call when credentials cannot be fetched
+	if config.credentials != nil {
+		if _, err := config.credentials.environ(); err != nil {
+			return nil, err
+		}
+	}
+	maxConcurrentPushes := d.Get("max_concurrent_pushes").(int)
+	if maxConcurrentPushes > 0 {
+		config.pushSemaphore = make(chan struct{}, maxConcurrentPushes)
+	}
+	return config, nil
+}
+
+func proxyEnv(name, value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{name + "=" + value, strings.ToLower(name) + "=" + value}
+}
+
+// environ returns the environment of the CLI calls made for this provider
+// instance with its settings and current credentials.
+func (c *Config) environ() []string {
+	env := mergeEnv(os.Environ(), c.env...)
+	if c.credentials == nil {
+		return env
+	}
+	credentialsEnv, err := c.credentials.environ()
+	if err != nil {
+		log.Fatal("Error refreshing AWS credentials: ", err)
+	}
+	return mergeEnv(env, credentialsEnv...)
+}
+
+func (c *Config) acquirePush() {
+	if c.pushSemaphore != nil {
+		c.pushSemaphore <- struct{}{}
+	}
+}
+
+func (c *Config) releasePush() {
+	if c.pushSemaphore != nil {
+		<-c.pushSemaphore
 	}
-}
\ No newline at end of file
+}
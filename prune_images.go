@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+)
+
+// BatchDeleteImage accepts at most 100 image ids per call
+const batchDeleteImageLimit = 100
+
+// ResourcePruneImages deletes the tagged images of a repository that are
+// older than older_than_days or beyond the keep_latest most recently pushed
+// ones. With both set an image has to match both to be deleted. Untagged
+// images can be manifests of a multi-platform index and are left to the
+// lifecycle policy of the repository. The prune runs on create, change any
+// attribute or the triggers to run it again.
+func ResourcePruneImages() *schema.Resource {
+	return &schema.Resource{
+		Create: resourcePruneImagesCreate,
+		Read:   resourcePruneImagesRead,
+		Delete: resourcePruneImagesDelete,
+		Schema: map[string]*schema.Schema{
+			"ecr_repository_name": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringMatch(repositoryNameRegexp, "must be a valid ECR repository name"),
+			},
+			"aws_region": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"AWS_REGION", "AWS_DEFAULT_REGION"}, nil),
+			},
+			"older_than_days": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				AtLeastOneOf: []string{"older_than_days", "keep_latest"},
+			},
+			"keep_latest": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				AtLeastOneOf: []string{"older_than_days", "keep_latest"},
+			},
+			// Only report the images in pruned_digests without deleting them
+			"dry_run": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				ForceNew: true,
+			},
+			"triggers": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				ForceNew: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"pruned_digests": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+type imageDetail struct {
+	Digest   string      `json:"digest"`
+	Tags     []string    `json:"tags"`
+	PushedAt interface{} `json:"pushedAt"`
+}
+
+func resourcePruneImagesCreate(d *schema.ResourceData, meta interface{}) error {
+	config := meta.(*Config)
+	opts := config.defaultAWSCallOptions()
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+
+	// Deleting images in a repository of the wrong account cannot be undone
+	if err := checkExpectedAccount(opts, awsRegion, config); err != nil {
+		log.Fatal(err)
+	}
+	images, err := describeImages(opts, repoName, awsRegion)
+	if err != nil {
+		log.Fatal("Error describing images: ", err)
+	}
+	prunedDigests := selectPrunedImages(images, d.Get("older_than_days").(int), d.Get("keep_latest").(int), time.Now())
+	if d.Get("dry_run").(bool) {
+		for _, digest := range prunedDigests {
+			fmt.Println("Dry run, would delete image ", digest)
+		}
+	} else if len(prunedDigests) > 0 {
+		fmt.Println("Deleting ", len(prunedDigests), " images from ", repoName)
+		err = batchDeleteImages(opts, repoName, prunedDigests, awsRegion)
+		if err != nil {
+			log.Fatal("Error deleting images: ", err)
+		}
+	}
+	d.SetId(fmt.Sprintf("%s/%s:%d", awsRegion, repoName, time.Now().Unix()))
+	d.Set("pruned_digests", prunedDigests)
+	return nil
+}
+
+// The prune is a one-off action, there is nothing to refresh
+func resourcePruneImagesRead(d *schema.ResourceData, meta interface{}) error {
+	return nil
+}
+
+func resourcePruneImagesDelete(d *schema.ResourceData, meta interface{}) error {
+	return nil
+}
+
+// selectPrunedImages returns the digests of the tagged images to delete, the
+// newest images are kept first.
+func selectPrunedImages(images []imageDetail, olderThanDays, keepLatest int, now time.Time) []string {
+	tagged := []imageDetail{}
+	pushedAt := map[string]time.Time{}
+	for _, image := range images {
+		if len(image.Tags) == 0 {
+			continue
+		}
+		tagged = append(tagged, image)
+		pushedAt[image.Digest] = parseCLITimestamp(image.PushedAt)
+	}
+	sort.SliceStable(tagged, func(i, j int) bool {
+		return pushedAt[tagged[i].Digest].After(pushedAt[tagged[j].Digest])
+	})
+	prunedDigests := []string{}
+	for i, image := range tagged {
+		if keepLatest > 0 && i < keepLatest {
+			continue
+		}
+		if olderThanDays > 0 && now.Sub(pushedAt[image.Digest]) < time.Duration(olderThanDays)*24*time.Hour {
+			continue
+		}
+		prunedDigests = append(prunedDigests, image.Digest)
+	}
+	return prunedDigests
+}
+
+// parseCLITimestamp reads a timestamp of the aws CLI, an ISO 8601 string from
+// v2 or epoch seconds from v1. Unknown formats count as now, so images with
+// them are kept.
+func parseCLITimestamp(timestamp interface{}) time.Time {
+	switch value := timestamp.(type) {
+	case string:
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			return parsed
+		}
+	case float64:
+		return time.Unix(int64(value), 0)
+	}
+	return time.Now()
+}
+
+// describeImages lists digest, tags and push time of every image in the
+// repository, the aws CLI follows the pagination of DescribeImages.
+func describeImages(opts awsCallOptions, repoName, awsRegion string) ([]imageDetail, error) {
+	describeImages, cancel := opts.command("aws", "ecr", "describe-images", "--repository-name", repoName, "--query", "imageDetails[].{digest: imageDigest, tags: imageTags, pushedAt: imagePushedAt}", "--output", "json", "--region", awsRegion)
+	defer cancel()
+	out, err := describeImages.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return nil, err
+	}
+	var images []imageDetail
+	if err := json.Unmarshal(out, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func batchDeleteImages(opts awsCallOptions, repoName string, imageDigests []string, awsRegion string) error {
+	for start := 0; start < len(imageDigests); start += batchDeleteImageLimit {
+		end := start + batchDeleteImageLimit
+		if end > len(imageDigests) {
+			end = len(imageDigests)
+		}
+		cmdArgs := []string{"ecr", "batch-delete-image", "--repository-name", repoName, "--query", "failures[].[imageId.imageDigest, failureReason]", "--output", "text", "--region", awsRegion, "--image-ids"}
+		for _, digest := range imageDigests[start:end] {
+			cmdArgs = append(cmdArgs, "imageDigest="+digest)
+		}
+		batchDelete, cancel := opts.command("aws", cmdArgs...)
+		out, err := batchDelete.CombinedOutput()
+		cancel()
+		if err != nil {
+			fmt.Println(string(out))
+			return err
+		}
+		if failures := strings.TrimSpace(string(out)); failures != "" && failures != "None" {
+			return fmt.Errorf("some images were not deleted:\n%s", failures)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectPrunedImages(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) string {
+		return now.Add(-time.Duration(days) * 24 * time.Hour).Format(time.RFC3339)
+	}
+	images := []imageDetail{
+		{Digest: "sha256:b", Tags: []string{"v2"}, PushedAt: daysAgo(20)},
+		{Digest: "sha256:d", Tags: []string{"v4", "latest"}, PushedAt: daysAgo(1)},
+		{Digest: "sha256:a", Tags: []string{"v1"}, PushedAt: daysAgo(40)},
+		{Digest: "sha256:untagged", PushedAt: daysAgo(90)},
+		{Digest: "sha256:c", Tags: []string{"v3"}, PushedAt: daysAgo(5)},
+	}
+	for name, test := range map[string]struct {
+		olderThanDays int
+		keepLatest    int
+		expected      []string
+	}{
+		"keep latest keeps the newest": {
+			keepLatest: 2,
+			expected:   []string{"sha256:b", "sha256:a"},
+		},
+		"keep latest above the image count": {
+			keepLatest: 10,
+			expected:   []string{},
+		},
+		"older than days": {
+			olderThanDays: 10,
+			expected:      []string{"sha256:b", "sha256:a"},
+		},
+		"both have to match": {
+			olderThanDays: 30,
+			keepLatest:    1,
+			expected:      []string{"sha256:a"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			prunedDigests := selectPrunedImages(images, test.olderThanDays, test.keepLatest, now)
+			if reflect.DeepEqual(prunedDigests, test.expected) != true {
+				t.Errorf("expected %v, got %v", test.expected, prunedDigests)
+			}
+		})
+	}
+}
+
+func TestSelectPrunedImagesEpochTimestamps(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	images := []imageDetail{
+		{Digest: "sha256:old", Tags: []string{"v1"}, PushedAt: float64(now.Add(-48 * time.Hour).Unix())},
+		{Digest: "sha256:new", Tags: []string{"v2"}, PushedAt: float64(now.Add(-time.Hour).Unix())},
+		{Digest: "sha256:unknown", Tags: []string{"v3"}, PushedAt: nil},
+	}
+	prunedDigests := selectPrunedImages(images, 1, 0, now)
+	if reflect.DeepEqual(prunedDigests, []string{"sha256:old"}) != true {
+		t.Errorf("expected only sha256:old, got %v", prunedDigests)
+	}
+}
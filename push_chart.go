@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+)
+
+// ResourcePushChart pushes a packaged Helm chart to an ECR repository as an
+// OCI artifact, authenticating the same way as image pushes.
+func ResourcePushChart() *schema.Resource {
+	return &schema.Resource{
+		Create: resourcePushChartCreate,
+		Read:   resourcePushChartRead,
+		Delete: resourcePushChartDelete,
+		Schema: map[string]*schema.Schema{
+			"chart_path": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			// The last path component must match the chart name
+			"ecr_repository_name": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringMatch(repositoryNameRegexp, "must be a valid ECR repository name"),
+			},
+			"aws_region": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"AWS_REGION", "AWS_DEFAULT_REGION"}, nil),
+			},
+			// Registry host to push to instead of the one of the repository URI, like for images
+			"registry_endpoint_override": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			"chart_version": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"image_digest": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourcePushChartCreate(d *schema.ResourceData, meta interface{}) error {
+
+	config := meta.(*Config)
+	opts := config.defaultAWSCallOptions()
+	chartPath := d.Get("chart_path").(string)
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+
+	if err := checkExpectedAccount(opts, awsRegion, config); err != nil {
+		log.Fatal(err)
+	}
+	chartName, chartVersion, err := getChartMetadata(opts, chartPath)
+	if err != nil {
+		log.Fatal("Error reading Helm chart: ", err)
+	}
+	if path.Base(repoName) != chartName {
+		log.Fatal("The ECR repository name must end with the chart name ", chartName)
+	}
+
+	out, err := repoExists(opts, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if out != true {
+		log.Fatal("The provided ECR repository does not exist")
+	}
+	tagMutable, err := isTagMutable(opts, chartVersion, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tagAlreadyExists, err := imageTagExist(opts, chartVersion, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tagAlreadyExists == true && tagMutable == false {
+		log.Fatal("The repo is immutable and the chart version already exists in it")
+	}
+
+	// Charts go to the same host as the images of this provider configuration
+	_, ecrUriWithRepo, err := resolveRepositoryUri(opts, repoName, awsRegion, config)
+	if err != nil {
+		log.Fatal("Error retrieving the repository URI: ", err)
+	}
+	pushUri, err := getPushUri(d, opts, config, ecrUriWithRepo, awsRegion, repoName, chartVersion)
+	if err != nil {
+		log.Fatal("Error building the push URI: ", err)
+	}
+	// helm push appends the chart name and version to the OCI reference
+	chartReference := fmt.Sprintf("/%s:%s", chartName, chartVersion)
+	if strings.HasSuffix(pushUri, chartReference) != true {
+		log.Fatal("The push URI ", pushUri, " has to end with the chart name and version for helm push")
+	}
+
+	fmt.Println("Pushing Helm chart: ", chartName)
+	config.acquirePush()
+	err = pushHelmChart(opts, chartPath, strings.TrimSuffix(pushUri, chartReference), awsRegion)
+	config.releasePush()
+	if err != nil {
+		log.Fatal("Error pushing Helm chart: ", err)
+	}
+	fmt.Println("Helm chart successfully pushed to ECR")
+
+	imageDigest, err := getImageDigest(opts, repoName, chartVersion, awsRegion)
+	if err != nil {
+		log.Fatal("Error retrieving Image digest: ", err)
+	}
+	d.SetId(imageDigest)
+	d.Set("chart_version", chartVersion)
+	d.Set("image_digest", imageDigest)
+
+	return resourcePushChartRead(d, meta)
+}
+
+func resourcePushChartRead(d *schema.ResourceData, meta interface{}) error {
+
+	config := meta.(*Config)
+	opts := config.defaultAWSCallOptions()
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+
+	out, err := imageDigestExist(opts, d.Id(), tagStatusAny, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if out != true {
+		d.SetId("")
+	}
+	return nil
+}
+
+func resourcePushChartDelete(d *schema.ResourceData, meta interface{}) error {
+
+	config := meta.(*Config)
+	opts := config.defaultAWSCallOptions()
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+
+	if err := checkExpectedAccount(opts, awsRegion, config); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Deleting Helm chart")
+	err := deleteImageByDigest(opts, repoName, d.Id(), awsRegion)
+	if err != nil {
+		log.Fatal("Error deleting Helm chart", err)
+	}
+	fmt.Println("Helm chart successfully removed from ECR")
+
+	return nil
+}
+
+// getChartMetadata reads the chart name and version from the packaged chart.
+func getChartMetadata(opts awsCallOptions, chartPath string) (string, string, error) {
+	showChart := opts.toolCommand("helm", "show", "chart", chartPath)
+	out, err := showChart.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return "", "", err
+	}
+	var chartName, chartVersion string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "name:") {
+			chartName = strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "name:")), `"'`)
+		}
+		if strings.HasPrefix(line, "version:") {
+			chartVersion = strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "version:")), `"'`)
+		}
+	}
+	if chartName == "" || chartVersion == "" {
+		return "", "", fmt.Errorf("Chart.yaml of %s has no name or version", chartPath)
+	}
+	return chartName, chartVersion, nil
+}
+
+// pushHelmChart pushes the chart below the registry path, the repository
+// URI without the chart name.
+func pushHelmChart(opts awsCallOptions, chartPath, registryPath, awsRegion string) error {
+	loginCommand := opts.toolCommand("bash", "-c", ecrLoginCommand(awsRegion, getUriHost(registryPath), "helm registry login"))
+	out, err := loginCommand.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	pushChart := opts.toolCommand("helm", "push", chartPath, "oci://"+registryPath)
+	out, err = pushChart.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	return nil
+}
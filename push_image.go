@@ -1,240 +1,3400 @@
 package main 
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"os/exec"
 	"fmt"
 	"strings"
 	"encoding/json"
+	"encoding/base64"
 	"log"
+	"net"
+	"net/http"
 	"errors"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/structure"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 )
 
+// Terraform drops resources without an ID after create, so disabled ones keep
+// this placeholder instead of an image digest.
+const disabledResourceId = "disabled"
+
 func ResourcePushImage() *schema.Resource {
 	return &schema.Resource{
 		Create: resourcePushImageCreate,
+		Read:   resourcePushImageRead,
 		Delete: resourcePushImageDelete,
 		Update: resourcePushImageUpdate,
+		CustomizeDiff: resourcePushImageCustomizeDiff,
 		Schema: map[string]*schema.Schema{
+				// Disabled resources build and push nothing, disabling removes the pushed image
+				"enabled": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  true,
+				},
+				// May contain a namespace path like team/service
 				"ecr_repository_name": {
-					Type:        schema.TypeString,
-					Required:    true,
+					Type:         schema.TypeString,
+					Required:     true,
+					ValidateFunc: validation.StringMatch(repositoryNameRegexp, "must be a valid ECR repository name: lowercase letters, digits and separators (., _, -) in slash separated namespace components"),
 				},
 				"dockerfile_path": {
 					Type:        schema.TypeString,
 					Optional:    true,
 					Default:     ".",
 				},
+				"create_repository": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Only used when the repository is created by this resource
+				"image_tag_mutability": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					Default:      "MUTABLE",
+					ValidateFunc: validation.StringInSlice([]string{"MUTABLE", "IMMUTABLE"}, false),
+				},
+				"encryption_configuration": {
+					Type:     schema.TypeList,
+					Optional: true,
+					MaxItems: 1,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"encryption_type": {
+								Type:         schema.TypeString,
+								Optional:     true,
+								Default:      "AES256",
+								ValidateFunc: validation.StringInSlice([]string{"AES256", "KMS"}, false),
+							},
+							"kms_key": {
+								Type:     schema.TypeString,
+								Optional: true,
+							},
+						},
+					},
+				},
+				"repository_policy": {
+					Type:             schema.TypeString,
+					Optional:         true,
+					ValidateFunc:     validation.StringIsJSON,
+					DiffSuppressFunc: structure.SuppressJsonDiff,
+				},
+				// Removing the attribute leaves the current lifecycle policy in place
+				"lifecycle_policy": {
+					Type:             schema.TypeString,
+					Optional:         true,
+					ValidateFunc:     validation.StringIsJSON,
+					DiffSuppressFunc: structure.SuppressJsonDiff,
+				},
+				// Kept when the resource is replaced because the image content changed
+				"delete_empty_repository": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"will_create_repository": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+				"repository_created": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+				"context_path": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"docker_config_dir": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				// The build settings come from the bake file, the build flags of the resource are not applied
+				"bake_file": {
+					Type:          schema.TypeString,
+					Optional:      true,
+					ConflictsWith: []string{"dockerfile_content", "context_tarball_path", "context_s3_uri", "exclude_patterns", "include_patterns", "variants", "build_ulimits", "extra_hosts", "keep_intermediate", "cache_from", "cache_from_self", "proxy_build_args", "skip_unchanged_build"},
+				},
+				"bake_target": {
+					Type:     schema.TypeString,
+					Optional: true,
+					Default:  "default",
+				},
+				"dockerfile_content": {
+					Type:          schema.TypeString,
+					Optional:      true,
+					RequiredWith:  []string{"context_path"},
+					ConflictsWith: []string{"context_tarball_path", "context_s3_uri"},
+				},
+				"exclude_patterns": {
+					Type:          schema.TypeList,
+					Optional:      true,
+					Elem:          &schema.Schema{Type: schema.TypeString},
+					ConflictsWith: []string{"context_tarball_path", "context_s3_uri"},
+				},
+				// Only the matching files and directories are sent as build context
+				"include_patterns": {
+					Type:          schema.TypeList,
+					Optional:      true,
+					Elem:          &schema.Schema{Type: schema.TypeString},
+					ConflictsWith: []string{"context_tarball_path", "context_s3_uri"},
+				},
+				"context_tarball_path": {
+					Type:          schema.TypeString,
+					Optional:      true,
+					ConflictsWith: []string{"context_path", "context_s3_uri"},
+				},
+				"context_s3_uri": {
+					Type:     schema.TypeString,
+					Optional: true,
+					ValidateFunc: validation.StringMatch(regexp.MustCompile(`^s3://[^/]+/.+`), "must be an s3://bucket/key URI"),
+				},
+				"context_s3_revision": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"content_hash": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
 				"image_name": {
 					Type: schema.TypeString,
-					Required: true,
+					Optional: true,
+					ValidateFunc: validateImageName,
+				},
+				"normalize_image_name": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
 				},
 				"image_tag": {
 					Type: schema.TypeString,
-					Required: true, 
+					Optional: true, 
+					ValidateFunc: validateImageTag,
+					ExactlyOneOf: []string{"image_tag", "tag_template"},
+				},
+				// Resolved once on create into effective_tag, e.g. {version}-{date}-{git_sha}
+				"tag_template": {
+					Type:     schema.TypeString,
+					Optional: true,
+					ForceNew: true,
+				},
+				"tag_version": {
+					Type:     schema.TypeString,
+					Optional: true,
+					ForceNew: true,
 				},
 
+				// Can be left out when AWS_REGION or AWS_DEFAULT_REGION is set
 				"aws_region": {
-					Type: schema.TypeString,
-					Required: true,
+					Type:        schema.TypeString,
+					Required:    true,
+					DefaultFunc: schema.MultiEnvDefaultFunc([]string{"AWS_REGION", "AWS_DEFAULT_REGION"}, nil),
+				},
+				"builder": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"extra_hosts": {
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem: &schema.Schema{
+						Type:         schema.TypeString,
+						ValidateFunc: validateExtraHost,
+					},
+				},
+				// Unset, the local images are removed when the CI variable of CI runners is set.
+				// That is decided at apply time, a schema default would make plans differ
+				// between CI and workstations
+				"cleanup_local_image": {
+					Type:     schema.TypeBool,
+					Optional: true,
+				},
+				"remove_stale_image_on_failure": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  true,
+				},
+				"keep_intermediate": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"on_immutable_conflict": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					Default:      "fail",
+					ValidateFunc: validation.StringInSlice([]string{"fail", "suffix"}, false),
+				},
+				"effective_tag": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				// Written to an OCI index the tag is moved to after the push, image_digest is then
+				// the digest of the index and layers are read from the image manifest it holds
+				"annotations": {
+					Type:     schema.TypeMap,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				// SLSA provenance attestation pushed with the image, requires BuildKit. The image
+				// is pushed straight from the build and not kept in the local image store
+				"provenance": {
+					Type:          schema.TypeString,
+					Optional:      true,
+					Default:       "false",
+					ValidateFunc:  validation.StringInSlice([]string{"false", "mode=min", "mode=max"}, false),
+					ConflictsWith: []string{"bake_file"},
+				},
+				// Hash the Dockerfile without line ending and trailing whitespace differences
+				"normalize_dockerfile_hash": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"skip_unchanged_build": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"build_log_path": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"pre_build_command": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"allow_classic_fallback": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"build_ulimits": {
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"name": {
+								Type:         schema.TypeString,
+								Required:     true,
+								ValidateFunc: validation.StringInSlice(knownUlimits, false),
+							},
+							"soft": {
+								Type:     schema.TypeInt,
+								Required: true,
+							},
+							"hard": {
+								Type:     schema.TypeInt,
+								Required: true,
+							},
+						},
+					},
+				},
+				// Pushing over an existing tag of a mutable repository is only logged as a
+				// warning, which shows with TF_LOG=WARN. fail_on_overwrite fails plan and apply
+				// instead unless confirm_overwrite acknowledges the overwrite
+				"confirm_overwrite": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"fail_on_overwrite": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Replica regions of the repository the apply waits for the pushed digest in
+				"wait_for_replication": {
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"replication_timeout": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					Default:      "10m",
+					ValidateFunc: validateDuration,
+				},
+				"verify_after_push": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"max_retries": {
+					Type:         schema.TypeInt,
+					Optional:     true,
+					ValidateFunc: validation.IntAtLeast(0),
+				},
+				"api_timeout": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					ValidateFunc: validateDuration,
+				},
+				// Pushes to a registry other than ECR, ecr_repository_name is the repository in it
+				"registry_host": {
+					Type:          schema.TypeString,
+					Optional:      true,
+					ForceNew:      true,
+					ConflictsWith: []string{"create_repository", "verify_after_push", "wait_for_replication", "expose_dockerconfigjson", "add_digest_tag", "auto_git_tag", "annotations", "repository_policy", "lifecycle_policy"},
+				},
+				"registry_endpoint_override": {
+					Type:          schema.TypeString,
+					Optional:      true,
+					ConflictsWith: []string{"registry_host"},
+				},
+				"registry_username": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"registry_password": {
+					Type:      schema.TypeString,
+					Optional:  true,
+					Sensitive: true,
+				},
+				// For test registries over HTTP or with self-signed certificates, never ECR
+				"insecure_skip_verify": {
+					Type:         schema.TypeBool,
+					Optional:     true,
+					Default:      false,
+					RequiredWith: []string{"registry_host"},
+				},
+				"auth_mode": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					Default:      "ecr_api",
+					ValidateFunc: validation.StringInSlice([]string{"ecr_api", "credential_helper"}, false),
+				},
+				"keep_previous_tag": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Pushes the local image under the new image_tag when the old tag is gone from ECR,
+				// only if the local image is the one pushed last
+				"repush_missing_image": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"previous_tags": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"add_digest_tag": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				"digest_tag": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				// Images used as build cache, the classic builder only uses images present locally
+				"cache_from": {
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				// Pulls the last pushed image as build cache, from image_tag or cache_from_self_tag
+				"cache_from_self": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Also set on every push, it is kept when the resource is destroyed so replacements find it
+				"cache_from_self_tag": {
+					Type:         schema.TypeString,
+					Optional:     true,
+					ValidateFunc: validateImageTag,
+					RequiredWith: []string{"cache_from_self"},
+				},
+				// Passes http_proxy, https_proxy and no_proxy of the provider as build args
+				"proxy_build_args": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Tags the image with the short commit of the git checkout holding the context
+				"auto_git_tag": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Without strict a context outside of git is pushed without the commit tag
+				"auto_git_tag_strict": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  true,
+				},
+				"git_commit_tag": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"image_digest": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"short_digest": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"aws_account_id": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"last_pushed_digest": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				// False once the tag resolves to an image pushed out of band
+				"image_pushed": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+				// Manifest the last tag change replaced, put-image restores it
+				"previous_manifest": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"provenance_attached": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+				// Layers docker push uploaded and the ones already in the registry
+				"layers_pushed": {
+					Type:     schema.TypeInt,
+					Computed: true,
+				},
+				"layers_reused": {
+					Type:     schema.TypeInt,
+					Computed: true,
+				},
+				"build_duration_seconds": {
+					Type:     schema.TypeFloat,
+					Computed: true,
+				},
+				"push_duration_seconds": {
+					Type:     schema.TypeFloat,
+					Computed: true,
+				},
+				"image_uri": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"registry_url": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				// Stores a pull secret for the registry in the state, refreshed on every read
+				"expose_dockerconfigjson": {
+					Type:     schema.TypeBool,
+					Optional: true,
+					Default:  false,
+				},
+				// Content of a kubernetes.io/dockerconfigjson secret, valid until expires_at
+				"dockerconfigjson": {
+					Type:      schema.TypeString,
+					Computed:  true,
+					Sensitive: true,
+				},
+				"expires_at": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"scan_on_push_enabled": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+				"repository_mutable": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+				"variants": {
+					Type:     schema.TypeList,
+					Optional: true,
+					ForceNew: true,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"tag": {
+								Type:     schema.TypeString,
+								Required: true,
+							},
+							"build_args": {
+								Type:     schema.TypeMap,
+								Optional: true,
+								Elem:     &schema.Schema{Type: schema.TypeString},
+							},
+							"target": {
+								Type:     schema.TypeString,
+								Optional: true,
+							},
+						},
+					},
+				},
+				"variant_digests": {
+					Type:     schema.TypeMap,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"platform_digests": {
+					Type:     schema.TypeMap,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				// Runtime config of the pushed image, empty for multi-platform images
+				"image_entrypoint": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"image_cmd": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"image_env": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"image_workingdir": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"layers": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"digest": {
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+							"size": {
+								Type:     schema.TypeInt,
+								Computed: true,
+							},
+						},
+					},
+				},
+				"scan_findings": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"name": {
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+							"severity": {
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+							"package": {
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+							"cvss": {
+								Type:     schema.TypeFloat,
+								Computed: true,
+							},
+							"uri": {
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+						},
+					},
+				},
+				"associated_tags": {
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
 				},
 			},
 		}
 	}
-
-
-func resourcePushImageCreate(d *schema.ResourceData, meta interface{}) error {
-	
-	awsRegion := d.Get("aws_region").(string)
-	repoName := d.Get("ecr_repository_name").(string)
-	imageName := d.Get("image_name").(string)
-	imageTag := d.Get("image_tag").(string)
-	dockerfilePath := d.Get("dockerfile_path").(string)
-	imageNameAndTag := fmt.Sprintf("%s:%s", imageName, imageTag)
-
-	out, err := repoExists(repoName, awsRegion)
+
+
+// Repository name grammar of ECR, namespaces are separated by slashes.
+var repositoryNameRegexp = regexp.MustCompile(`^(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+// Image name grammar of Docker references without tag or digest, an optional
+// registry host followed by lowercase path components.
+var imageNameRegexp = regexp.MustCompile(`^(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?/)?[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+
+// Tag grammar of Docker references.
+var imageTagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+func resourcePushImageCreate(d *schema.ResourceData, meta interface{}) error {
+	if d.Get("enabled").(bool) != true {
+		d.SetId(disabledResourceId)
+		d.Set("image_pushed", false)
+		return nil
+	}
+	
+	opts := getAWSCallOptions(d, meta.(*Config))
+	awsRegion := d.Get("aws_region").(string)
+	repoName := d.Get("ecr_repository_name").(string)
+	imageName := getImageName(d)
+	if d.Get("registry_host").(string) == "" {
+		if err := checkExpectedAccount(opts, awsRegion, meta.(*Config)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	imageTag := d.Get("image_tag").(string)
+	contextPath, dockerfile := getBuildContext(d)
+	var err error
+	if tagTemplate := d.Get("tag_template").(string); tagTemplate != "" {
+		imageTag, err = resolveTagTemplate(tagTemplate, d.Get("tag_version").(string), contextPath)
+		if err != nil {
+			log.Fatal("Error resolving tag_template: ", err)
+		}
+		fmt.Println("Resolved tag_template to ", imageTag)
+	}
+	imageNameAndTag := fmt.Sprintf("%s:%s", imageName, imageTag)
+	// Read before the context is replaced by an archive
+	gitCommitTag := ""
+	if d.Get("auto_git_tag").(bool) {
+		gitCommitTag, err = getGitShortSha(contextPath)
+		if err != nil && d.Get("auto_git_tag_strict").(bool) {
+			log.Fatal("Error reading the git commit for auto_git_tag: ", err)
+		}
+		if err != nil {
+			log.Printf("[WARN] Skipping auto_git_tag: %v", err)
+		}
+	}
+
+	registryHost := d.Get("registry_host").(string)
+	// Repository and tag checks use the ECR API and are skipped for a registry_host
+	if registryHost == "" {
+		out, err := repoExists(opts, repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if out != true {
+			if d.Get("create_repository").(bool) != true {
+				log.Fatal("The provided ECR repository does not exist")
+			}
+			fmt.Println("Creating ECR repository: ", repoName)
+			encryptionType, kmsKey := getEncryptionConfiguration(d)
+			err = createRepository(opts, repoName, d.Get("image_tag_mutability").(string), encryptionType, kmsKey, awsRegion)
+			if err != nil {
+				log.Fatal("Error creating ECR repository: ", err)
+			}
+			d.Set("repository_created", true)
+		}
+		if repositoryPolicy := d.Get("repository_policy").(string); repositoryPolicy != "" {
+			fmt.Println("Setting ECR repository policy")
+			err = setRepositoryPolicy(opts, repoName, repositoryPolicy, awsRegion)
+			if err != nil {
+				log.Fatal("Error setting ECR repository policy: ", err)
+			}
+		}
+		if lifecyclePolicy := d.Get("lifecycle_policy").(string); lifecyclePolicy != "" {
+			fmt.Println("Setting ECR lifecycle policy")
+			err = putLifecyclePolicy(opts, repoName, lifecyclePolicy, awsRegion)
+			if err != nil {
+				log.Fatal("Error setting ECR lifecycle policy: ", err)
+			}
+		}
+	}
+
+	config := meta.(*Config)
+	ecrUri, ecrUriWithRepo := registryHost, fmt.Sprintf("%s/%s", registryHost, repoName)
+	if registryHost == "" {
+		fmt.Println("Retrieving ECR repository URI")
+		ecrUri, ecrUriWithRepo, err = resolveRepositoryUri(opts, repoName, awsRegion, config)
+		if err != nil {
+			log.Fatal("Error retrieving ECR repository URI: ", err)
+		}
+	}
+	ecrUriWithTag := fmt.Sprintf("%s:%s", ecrUriWithRepo, imageTag)
+	if registryHost == "" {
+		ecrUriWithTag, err = getPushUri(d, opts, config, ecrUriWithRepo, awsRegion, repoName, imageTag)
+		if err != nil {
+			log.Fatal("Error building the push URI: ", err)
+		}
+		ecrUri = getUriHost(ecrUriWithTag)
+	}
+
+	builder := d.Get("builder").(string)
+	annotationFlags := getAnnotationFlags(d)
+	provenance := d.Get("provenance").(string)
+	dockerfileFeatures := getDockerfileBuildkitFeatures(d)
+	if features := getBuildkitFeatures(d); len(features)+len(dockerfileFeatures) > 0 {
+		err = buildkitAvailable(opts)
+		if err != nil && len(dockerfileFeatures) > 0 {
+			log.Fatal("BuildKit is required for the Dockerfile instructions ", strings.Join(dockerfileFeatures, ", "), " but is not available: ", err)
+		}
+		if err != nil && d.Get("allow_classic_fallback").(bool) != true {
+			log.Fatal("BuildKit is required for ", strings.Join(features, ", "), " but is not available: ", err)
+		}
+		if err != nil {
+			log.Printf("[WARN] BuildKit is not available (%v), building with the classic builder and ignoring %s", err, strings.Join(features, ", "))
+			builder = ""
+			annotationFlags = nil
+			provenance = "false"
+		}
+	}
+	if d.Get("bake_file").(string) != "" {
+		err = buildkitAvailable(opts)
+		if err != nil {
+			log.Fatal("BuildKit is required for bake_file but is not available: ", err)
+		}
+	}
+	if builder != "" {
+		err = builderExists(opts, builder, d.Get("docker_config_dir").(string))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// A context archive from S3 replaces the local context and Dockerfile paths
+	if contextS3Uri := d.Get("context_s3_uri").(string); contextS3Uri != "" {
+		fmt.Println("Downloading build context from ", contextS3Uri)
+		contextRevision, err := getS3ObjectRevision(opts, contextS3Uri, awsRegion)
+		if err != nil {
+			log.Fatal("Error reading build context from S3: ", err)
+		}
+		contextArchive, err := downloadS3Object(opts, contextS3Uri, awsRegion)
+		if err != nil {
+			log.Fatal("Error downloading build context from S3: ", err)
+		}
+		defer os.Remove(contextArchive)
+		contextPath, dockerfile = contextArchive, ""
+		d.Set("context_s3_revision", contextRevision)
+	}
+	if dockerfileContent := d.Get("dockerfile_content").(string); dockerfileContent != "" {
+		dockerfile, err = writeInlineDockerfile(dockerfileContent)
+		if err != nil {
+			log.Fatal("Error writing inline Dockerfile: ", err)
+		}
+		defer os.Remove(dockerfile)
+	}
+	if preBuildCommand := d.Get("pre_build_command").(string); preBuildCommand != "" {
+		fmt.Println("Running pre build command")
+		err = runPreBuildCommand(preBuildCommand, contextPath)
+		if err != nil {
+			log.Fatal("Error running pre build command: ", err)
+		}
+	}
+	contentHash, err := getContentHash(d, d.Get("context_s3_revision").(string))
+	if err != nil {
+		log.Fatal("Error calculating content hash: ", err)
+	}
+	d.Set("content_hash", contentHash)
+	buildLog, closeBuildLog, err := openBuildLog(d)
+	if err != nil {
+		log.Fatal("Error opening build log: ", err)
+	}
+	defer closeBuildLog()
+	// An image built from the same content is already behind the tag, skip the build and push
+	buildFlags := getBuildFlags(d, config)
+	cacheTag := ""
+	if d.Get("cache_from_self").(bool) && registryHost == "" {
+		cacheTag = d.Get("cache_from_self_tag").(string)
+		if cacheTag == "" {
+			cacheTag = imageTag
+		}
+	}
+	// Runs before the tag checks, the unchanged image is not overwritten
+	if d.Get("skip_unchanged_build").(bool) && registryHost == "" {
+		imageDigest, err := getUnchangedImageDigest(opts, repoName, imageTag, contentHash, awsRegion)
+		if err != nil {
+			log.Fatal("Error checking for an unchanged image: ", err)
+		}
+		if imageDigest != "" && len(d.Get("variants").([]interface{})) == 0 {
+			fmt.Println("Image content is unchanged, skipping build and push")
+			d.SetId(imageDigest)
+			d.Set("effective_tag", imageTag)
+			d.Set("last_pushed_digest", imageDigest)
+			d.Set("image_pushed", true)
+			tagPushedImage(d, opts, repoName, imageTag, imageDigest, cacheTag, gitCommitTag, awsRegion)
+			return readPushImage(d, meta)
+		}
+		buildFlags = append(buildFlags, "--label", fmt.Sprintf("%s=%s", contentHashLabel, contentHash))
+	}
+	if registryHost == "" {
+		checkTagConflicts(d, opts, repoName, imageTag, awsRegion)
+	}
+	if cacheTag != "" {
+		cacheUri, err := getPushUri(d, opts, config, ecrUriWithRepo, awsRegion, repoName, cacheTag)
+		if err != nil {
+			log.Fatal("Error building the push URI: ", err)
+		}
+		cacheExists, err := imageTagExist(opts, cacheTag, repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The first build has no previous image to use as cache
+		if cacheExists != true {
+			fmt.Println("No previous image ", cacheUri, " to use as build cache")
+		} else if err = pullCacheImage(opts, cacheUri, awsRegion, ecrUri, d.Get("auth_mode").(string), d.Get("docker_config_dir").(string)); err != nil {
+			log.Printf("[WARN] Building without cache, pulling %s failed: %v", cacheUri, err)
+		} else {
+			buildFlags = append(buildFlags, "--cache-from", cacheUri)
+		}
+		// Stores the cache metadata in the image, so BuildKit can use it from the registry
+		buildFlags = append(buildFlags, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+	}
+	if excludePatterns, includePatterns := getExcludePatterns(d), getIncludePatterns(d); len(excludePatterns) > 0 || len(includePatterns) > 0 {
+		contextArchive, dockerfileInArchive, err := archiveBuildContext(contextPath, dockerfile, excludePatterns, includePatterns)
+		if err != nil {
+			log.Fatal("Error archiving build context: ", err)
+		}
+		defer os.Remove(contextArchive)
+		contextPath, dockerfile = contextArchive, dockerfileInArchive
+	}
+	fmt.Println("Building Docker image: ", imageName)
+	buildStart := time.Now()
+	var pushedDigest string
+	var pushOutput bytes.Buffer
+	if provenance != "false" {
+		// The local image store drops attestations, so the image is built and
+		// pushed together with its provenance in a single step
+		err = loginResourceRegistry(opts, d, awsRegion, ecrUri)
+		if err != nil {
+			log.Fatal("Error logging in to the registry: ", err)
+		}
+		config.acquirePush()
+		pushedDigest, err = pushWithProvenance(opts, ecrUriWithTag, contextPath, dockerfile, builder, provenance, d.Get("docker_config_dir").(string), buildFlags, io.MultiWriter(buildLog, &pushOutput))
+		config.releasePush()
+		if err != nil {
+			log.Fatal("Error building and pushing Docker image: ", err)
+		}
+		d.Set("build_duration_seconds", time.Since(buildStart).Seconds())
+		d.Set("push_duration_seconds", 0)
+	} else {
+		if bakeFile := d.Get("bake_file").(string); bakeFile != "" {
+			err = bakeDockerImage(opts, imageNameAndTag, bakeFile, d.Get("bake_target").(string), builder, d.Get("docker_config_dir").(string), buildLog)
+		} else {
+			err = buildDockerImage(opts, imageNameAndTag, contextPath, dockerfile, builder, d.Get("docker_config_dir").(string), buildFlags, buildLog)
+		}
+		if err != nil {
+			if d.Get("remove_stale_image_on_failure").(bool) {
+				removeStaleImage(opts, imageNameAndTag)
+			}
+			log.Fatal("Error building Docker image: ", err)		
+		}
+		d.Set("build_duration_seconds", time.Since(buildStart).Seconds())
+		fmt.Println("Tagging Docker image")
+		err = tagDockerImage(opts, imageNameAndTag, ecrUriWithTag)
+		if err != nil {
+			log.Fatal("Error tagging Docker image: ", err)		
+		}
+		fmt.Println("Pushing Docker image")
+		config.acquirePush()
+		pushStart := time.Now()
+		pushedDigest, err = pushResourceImage(opts, d, ecrUriWithTag, awsRegion, ecrUri, io.MultiWriter(buildLog, &pushOutput))
+		config.releasePush()
+		if err != nil {
+			log.Fatal("Error pushing Docker image: ", err)		
+		}
+		d.Set("push_duration_seconds", time.Since(pushStart).Seconds())
+	}
+	layersPushed, layersReused := countPushedLayers(pushOutput.String())
+	d.Set("layers_pushed", layersPushed)
+	d.Set("layers_reused", layersReused)
+	if d.Get("verify_after_push").(bool) {
+		fmt.Println("Verifying pushed Docker image")
+		err = verifyPushedImage(opts, repoName, imageTag, pushedDigest, awsRegion)
+		if err != nil {
+			log.Fatal("Error verifying pushed Docker image: ", err)
+		}
+	}
+	d.Set("provenance_attached", provenance != "false")
+	if len(annotationFlags) > 0 {
+		fmt.Println("Annotating Docker image")
+		err = annotateImage(opts, ecrUriWithTag, annotationFlags)
+		if err != nil {
+			log.Fatal("Error annotating Docker image: ", err)
+		}
+	}
+	fmt.Println("Docker image successfully pushed to ECR")
+
+	imageDigest := pushedDigest
+	if registryHost == "" {
+		imageDigest, err = getImageDigest(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image digest: ", err)
+		}
+	}
+	d.SetId(imageDigest)
+	d.Set("effective_tag", imageTag)
+	d.Set("last_pushed_digest", imageDigest)
+	d.Set("image_pushed", true)
+
+	tagPushedImage(d, opts, repoName, imageTag, imageDigest, cacheTag, gitCommitTag, awsRegion)
+
+	localImages := []string{}
+	if provenance == "false" {
+		localImages = append(localImages, imageNameAndTag, ecrUriWithTag)
+	}
+	for _, raw := range d.Get("variants").([]interface{}) {
+		variant := raw.(map[string]interface{})
+		variantTag := variant["tag"].(string)
+		variantNameAndTag := fmt.Sprintf("%s:%s", imageName, variantTag)
+		variantUriWithTag := fmt.Sprintf("%s:%s", ecrUriWithRepo, variantTag)
+		if registryHost == "" {
+			variantUriWithTag, err = getPushUri(d, opts, config, ecrUriWithRepo, awsRegion, repoName, variantTag)
+			if err != nil {
+				log.Fatal("Error building the push URI: ", err)
+			}
+		}
+		variantFlags := append(getBuildFlags(d, config), getVariantBuildFlags(variant)...)
+
+		fmt.Println("Building Docker image variant: ", variantTag)
+		err = buildDockerImage(opts, variantNameAndTag, contextPath, dockerfile, builder, d.Get("docker_config_dir").(string), variantFlags, buildLog)
+		if err != nil {
+			if d.Get("remove_stale_image_on_failure").(bool) {
+				removeStaleImage(opts, variantNameAndTag)
+			}
+			log.Fatal("Error building Docker image variant ", variantTag, ": ", err)
+		}
+		err = tagDockerImage(opts, variantNameAndTag, variantUriWithTag)
+		if err != nil {
+			log.Fatal("Error tagging Docker image variant ", variantTag, ": ", err)
+		}
+		config.acquirePush()
+		_, err = pushResourceImage(opts, d, variantUriWithTag, awsRegion, ecrUri, buildLog)
+		config.releasePush()
+		if err != nil {
+			log.Fatal("Error pushing Docker image variant ", variantTag, ": ", err)
+		}
+		localImages = append(localImages, variantNameAndTag, variantUriWithTag)
+	}
+
+	cleanupLocalImage, configured := d.GetOkExists("cleanup_local_image")
+	if configured != true {
+		cleanupLocalImage = os.Getenv("CI") != ""
+	}
+	if cleanupLocalImage.(bool) {
+		fmt.Println("Removing local Docker images")
+		err = removeLocalImages(opts, localImages)
+		if err != nil {
+			log.Printf("[WARN] Error removing local Docker images: %v", err)
+		}
+	}
+
+	return readPushImage(d, meta)
+}
+
+// checkTagConflicts fails before the build when the tag or a variant tag
+// already exists and cannot be overwritten.
+func checkTagConflicts(d *schema.ResourceData, opts awsCallOptions, repoName, imageTag, awsRegion string) {
+	tagAlreadyExists, err := checkImmutableTag(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tagAlreadyExists == true {
+		checkTagOverwrite(d, imageTag, repoName)
+	}
+	for _, variantTag := range getVariantTags(d) {
+		_, err := checkImmutableTag(opts, repoName, variantTag, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// checkImmutableTag fails when the tag already exists and the repository does
+// not allow overwriting it. It returns whether the tag exists.
+func checkImmutableTag(opts awsCallOptions, repoName, imageTag, awsRegion string) (bool, error) {
+	repoMutability, err := isTagMutable(opts, imageTag, repoName, awsRegion)
+	if err != nil {
+		return false, err
+	}
+	tagAlreadyExists, err := imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil {
+		return false, err
+	}
+	if tagAlreadyExists == true && repoMutability == false {
+		return true, fmt.Errorf("The repo is immutable and you are trying to push an image with a tag that already exists in it: %s", imageTag)
+	}
+	return tagAlreadyExists, nil
+}
+
+// tagPushedImage waits for replication and adds the secondary tags of the
+// image behind the tag, after a push and when an unchanged image is reused.
+func tagPushedImage(d *schema.ResourceData, opts awsCallOptions, repoName, imageTag, imageDigest, cacheTag, gitCommitTag, awsRegion string) {
+	if replicaRegions := d.Get("wait_for_replication").([]interface{}); len(replicaRegions) > 0 {
+		replicationTimeout, _ := time.ParseDuration(d.Get("replication_timeout").(string))
+		for _, replicaRegion := range replicaRegions {
+			fmt.Println("Waiting for replication to ", replicaRegion)
+			err := waitForReplication(opts, repoName, imageDigest, replicaRegion.(string), replicationTimeout)
+			if err != nil {
+				log.Fatal("Error waiting for replication: ", err)
+			}
+		}
+	}
+	if d.Get("add_digest_tag").(bool) {
+		err := addDigestTag(opts, repoName, imageTag, imageDigest, awsRegion)
+		if err != nil {
+			log.Fatal("Error adding digest tag: ", err)
+		}
+	}
+	if cacheTag != "" && cacheTag != imageTag {
+		imageManifest, err := getImageManifest(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image manifest: ", err)
+		}
+		err = updateImageTag(opts, imageManifest, repoName, cacheTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error updating cache tag: ", err)
+		}
+	}
+	if gitCommitTag != "" {
+		imageManifest, err := getImageManifest(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image manifest: ", err)
+		}
+		err = updateImageTag(opts, imageManifest, repoName, gitCommitTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error adding git commit tag: ", err)
+		}
+		d.Set("git_commit_tag", gitCommitTag)
+	}
+}
+
+// resourcePushImageRead only checks that the tag still exists when the provider
+// has lightweight_read enabled and keeps the stored state. A missing tag falls
+// through to the full read, which resolves the image by digest.
+func resourcePushImageRead(d *schema.ResourceData, meta interface{}) error {
+	if d.Get("enabled").(bool) != true {
+		return nil
+	}
+	if d.Get("effective_tag").(string) == "" {
+		d.Set("effective_tag", getEffectiveTag(d))
+	}
+	if meta.(*Config).lightweightRead && d.Get("registry_host").(string) == "" {
+		opts := getAWSCallOptions(d, meta.(*Config))
+		tagExists, err := imageTagExist(opts, getEffectiveTag(d), d.Get("ecr_repository_name").(string), d.Get("aws_region").(string))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tagExists == true {
+			return nil
+		}
+	}
+	return readPushImage(d, meta)
+}
+
+// readPushImage refreshes the whole state from ECR, create and update always use it.
+func readPushImage(d *schema.ResourceData, meta interface{}) error {
+	if d.Get("registry_host").(string) != "" {
+		return readRegistryImage(d)
+	}
+
+	opts := getAWSCallOptions(d, meta.(*Config))
+	repoName := d.Get("ecr_repository_name").(string)
+	imageTag := getEffectiveTag(d)
+	awsRegion := d.Get("aws_region").(string)
+
+	out, err := imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imageDigest := d.Get("image_digest").(string)
+	if out == true {
+		tagDigest, err := getImageDigest(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image digest: ", err)
+		}
+		// A different digest behind the tag means the image was replaced out of band
+		if lastPushedDigest := d.Get("last_pushed_digest").(string); lastPushedDigest != "" && tagDigest != lastPushedDigest {
+			log.Printf("[WARN] Tag %s now resolves to %s instead of the pushed %s", imageTag, tagDigest, lastPushedDigest)
+			d.Set("image_pushed", false)
+			imageDigest = lastPushedDigest
+			out = false
+		} else {
+			imageDigest = tagDigest
+		}
+	}
+	if out != true {
+		// The tag was moved or deleted out of band, keep tracking the pushed digest while it exists
+		digestExists := false
+		if imageDigest != "" {
+			digestExists, err = imageDigestExist(opts, imageDigest, tagStatusAny, repoName, awsRegion)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if digestExists != true {
+			d.SetId("")
+			return nil
+		}
+	}
+	d.Set("image_digest", imageDigest)
+	d.Set("short_digest", getShortDigest(imageDigest))
+	if out == true {
+		layers, err := getImageLayers(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image layers: ", err)
+		}
+		d.Set("layers", layers)
+		platformDigests, err := getPlatformDigests(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving platform digests: ", err)
+		}
+		d.Set("platform_digests", platformDigests)
+		imageConfig, err := getImageConfig(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image config: ", err)
+		}
+		if imageConfig != nil {
+			d.Set("image_entrypoint", imageConfig.Config.Entrypoint)
+			d.Set("image_cmd", imageConfig.Config.Cmd)
+			d.Set("image_env", imageConfig.Config.Env)
+			d.Set("image_workingdir", imageConfig.Config.WorkingDir)
+		}
+	}
+	scanFindings, err := getScanFindings(opts, repoName, imageDigest, awsRegion)
+	if err != nil {
+		log.Fatal("Error retrieving scan findings: ", err)
+	}
+	d.Set("scan_findings", scanFindings)
+
+	variantDigests := map[string]string{}
+	for _, variantTag := range getVariantTags(d) {
+		variantExists, err := imageTagExist(opts, variantTag, repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if variantExists != true {
+			continue
+		}
+		variantDigests[variantTag], err = getImageDigest(opts, repoName, variantTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image digest: ", err)
+		}
+	}
+	d.Set("variant_digests", variantDigests)
+	d.SetId(getResourceId(imageDigest, variantDigests))
+
+	associatedTags, err := getAssociatedTags(opts, repoName, imageDigest, awsRegion)
+	if err != nil {
+		log.Fatal("Error retrieving associated tags: ", err)
+	}
+	d.Set("associated_tags", associatedTags)
+
+	repoMutability, err := isMutable(opts, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.Set("repository_mutable", repoMutability)
+
+	scanOnPush, err := isScanOnPushEnabled(opts, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.Set("scan_on_push_enabled", scanOnPush)
+
+	// Only a managed policy is refreshed, so drift shows up in the plan
+	if d.Get("repository_policy").(string) != "" {
+		repositoryPolicy, err := getRepositoryPolicy(opts, repoName, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving ECR repository policy: ", err)
+		}
+		d.Set("repository_policy", repositoryPolicy)
+	}
+	if d.Get("lifecycle_policy").(string) != "" {
+		lifecyclePolicy, err := getLifecyclePolicy(opts, repoName, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving ECR lifecycle policy: ", err)
+		}
+		d.Set("lifecycle_policy", lifecyclePolicy)
+	}
+
+	awsAccountId, err := resolveAWSAccountID(opts, awsRegion, meta.(*Config))
+	if err != nil {
+		log.Fatal("Error retrieving AWS account Id: ", err)
+	}
+	d.Set("aws_account_id", awsAccountId)
+
+	_, ecrUriWithRepo, err := resolveRepositoryUri(opts, repoName, awsRegion, meta.(*Config))
+	if err != nil {
+		log.Fatal("Error retrieving ECR repository URI: ", err)
+	}
+	imageUri, err := getPushUri(d, opts, meta.(*Config), ecrUriWithRepo, awsRegion, repoName, imageTag)
+	if err != nil {
+		log.Fatal("Error building the push URI: ", err)
+	}
+	d.Set("registry_url", getUriHost(imageUri))
+	d.Set("image_uri", imageUri)
+	if d.Get("expose_dockerconfigjson").(bool) {
+		dockerConfigJson, expiresAt, err := getDockerConfigJson(opts, getUriHost(imageUri), awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving ECR authorization token: ", err)
+		}
+		d.Set("dockerconfigjson", dockerConfigJson)
+		d.Set("expires_at", expiresAt)
+	} else {
+		d.Set("dockerconfigjson", "")
+		d.Set("expires_at", "")
+	}
+
+	if d.Get("add_digest_tag").(bool) {
+		d.Set("digest_tag", getDigestTag(imageDigest))
+	} else {
+		d.Set("digest_tag", "")
+	}
+
+	return nil
+}
+
+
+func resourcePushImageCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	if d.Get("enabled").(bool) != true {
+		return nil
+	}
+	// Enabling a disabled resource pushes like a create
+	newResource := d.Id() == "" || d.Id() == disabledResourceId
+	if d.Get("registry_host").(string) == "" && (newResource || d.HasChange("image_tag")) {
+		if err := checkPlannedTagConflict(d, meta); err != nil {
+			return err
+		}
+	}
+	if registryHost := d.Get("registry_host").(string); d.Get("insecure_skip_verify").(bool) && isECRHost(registryHost) {
+		return fmt.Errorf("insecure_skip_verify cannot be used with the ECR registry %s", registryHost)
+	}
+	if imageName := d.Get("image_name").(string); imageName != strings.ToLower(imageName) {
+		if d.Get("normalize_image_name").(bool) != true {
+			return fmt.Errorf("image_name %s must be lowercase, set normalize_image_name to lowercase it", imageName)
+		}
+		log.Printf("[WARN] image_name %s is normalized to %s", imageName, strings.ToLower(imageName))
+	}
+	if err := checkVariantTags(d); err != nil {
+		return err
+	}
+	if encryptionType, kmsKey := getEncryptionConfiguration(d); kmsKey != "" && encryptionType != "KMS" {
+		return fmt.Errorf("encryption_configuration.kms_key can only be set with encryption_type KMS, got %s", encryptionType)
+	}
+	if newResource && d.Get("create_repository").(bool) && d.Get("registry_host").(string) == "" {
+		if err := planRepositoryCreation(d, meta); err != nil {
+			return err
+		}
+	}
+	contextRevision := ""
+	if contextS3Uri := d.Get("context_s3_uri").(string); contextS3Uri != "" {
+		var err error
+		contextRevision, err = getS3ObjectRevision(getAWSCallOptions(d, meta.(*Config)), contextS3Uri, d.Get("aws_region").(string))
+		if err != nil {
+			return fmt.Errorf("Error reading build context from S3: %v", err)
+		}
+		if contextRevision != d.Get("context_s3_revision").(string) {
+			if err := d.SetNew("context_s3_revision", contextRevision); err != nil {
+				return err
+			}
+		}
+	}
+	// Read found the tag replaced out of band, replacing the resource here would
+	// also hit every state written before image_pushed existed
+	if newResource != true && d.Get("image_pushed").(bool) != true && d.Get("last_pushed_digest").(string) != "" {
+		log.Printf("[WARN] Tag %s no longer resolves to the pushed image %s, taint the resource to push it again", getEffectiveTag(d), d.Get("last_pushed_digest").(string))
+	}
+	if err := checkDockerfileExists(d); err != nil {
+		return err
+	}
+	// Rebuild whenever any input of the image content changed since the last push
+	contentHash, err := getContentHash(d, contextRevision)
+	if err != nil {
+		return fmt.Errorf("Error calculating content hash: %v", err)
+	}
+	if contentHash != d.Get("content_hash").(string) {
+		if err := d.SetNew("content_hash", contentHash); err != nil {
+			return err
+		}
+		if newResource != true {
+			return d.ForceNew("content_hash")
+		}
+	}
+	return nil
+}
+
+// checkDockerfileExists fails the plan with a readable message when the
+// configured Dockerfile was removed, instead of the error of hashing it.
+func checkDockerfileExists(d resourceGetter) error {
+	if d.Get("context_s3_uri").(string) != "" || d.Get("bake_file").(string) != "" {
+		return nil
+	}
+	contextPath, dockerfile := getBuildContext(d)
+	if dockerfile == "" && d.Get("context_tarball_path").(string) == "" && d.Get("dockerfile_content").(string) == "" {
+		dockerfile = filepath.Join(contextPath, "Dockerfile")
+	}
+	if dockerfile == "" {
+		return nil
+	}
+	if _, err := os.Stat(dockerfile); os.IsNotExist(err) {
+		return fmt.Errorf("The configured Dockerfile %s no longer exists, restore it or update dockerfile_path and context_path", dockerfile)
+	}
+	return nil
+}
+
+// planRepositoryCreation shows in the plan whether apply is going to create the repository.
+func planRepositoryCreation(d *schema.ResourceDiff, meta interface{}) error {
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+	if repoName == "" || awsRegion == "" {
+		return nil
+	}
+	opts := getAWSCallOptions(d, meta.(*Config))
+	exists, err := repoExists(opts, repoName, awsRegion)
+	if err != nil {
+		return err
+	}
+	if exists != true {
+		log.Printf("[INFO] ECR repository %s does not exist and will be created", repoName)
+	}
+	return d.SetNew("will_create_repository", exists != true)
+}
+
+// checkPlannedTagConflict fails the plan when the planned tag already exists
+// in a repository that does not allow overwriting it, the apply would fail
+// the same way after the build, or in a mutable one with fail_on_overwrite.
+// SDK v1 has no warnings to show in the plan, any other overwrite is logged.
+func checkPlannedTagConflict(d *schema.ResourceDiff, meta interface{}) error {
+	repoName := d.Get("ecr_repository_name").(string)
+	imageTag := d.Get("image_tag").(string)
+	awsRegion := d.Get("aws_region").(string)
+	if repoName == "" || imageTag == "" || awsRegion == "" {
+		return nil
+	}
+	opts := getAWSCallOptions(d, meta.(*Config))
+	tagExists, err := imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil || tagExists != true {
+		return nil
+	}
+	tagMutable, err := isTagMutable(opts, imageTag, repoName, awsRegion)
+	if err != nil {
+		return nil
+	}
+	if tagMutable != true {
+		// Only an update of the tag moves to a suffixed tag, a create fails
+		if d.Id() != "" && d.Id() != disabledResourceId && d.Get("on_immutable_conflict").(string) == "suffix" {
+			log.Printf("[WARN] Tag %s already exists in repository %s, which is immutable for this tag, the image will be tagged with a digest suffix", imageTag, repoName)
+			return nil
+		}
+		return fmt.Errorf("Tag %s already exists in repository %s, which is immutable for this tag. Choose another image_tag or set on_immutable_conflict to suffix for updates", imageTag, repoName)
+	}
+	if d.Get("confirm_overwrite").(bool) == true {
+		return nil
+	}
+	if d.Get("fail_on_overwrite").(bool) == true {
+		return fmt.Errorf("The tag %s already exists in repository %s, set confirm_overwrite to overwrite it", imageTag, repoName)
+	}
+	log.Printf("[WARN] Tag %s already exists in repository %s and will be overwritten, set confirm_overwrite to acknowledge", imageTag, repoName)
+	return nil
+}
+
+// checkTagOverwrite handles pushing over an existing tag of a mutable
+// repository, which needs confirm_overwrite to pass silently.
+func checkTagOverwrite(d *schema.ResourceData, imageTag, repoName string) {
+	if d.Get("confirm_overwrite").(bool) == true {
+		return
+	}
+	if d.Get("fail_on_overwrite").(bool) == true {
+		log.Fatal("The tag ", imageTag, " already exists in repository ", repoName, ", set confirm_overwrite to overwrite it")
+	}
+	log.Printf("[WARN] Overwriting existing tag %s in repository %s", imageTag, repoName)
+}
+
+func resourcePushImageDelete(d *schema.ResourceData, meta interface{}) error { 
+	if d.Get("enabled").(bool) != true {
+		return nil
+	}
+	return deletePushedImage(d, meta)
+}
+
+// deletePushedImage removes the pushed image with its secondary tags, on
+// destroy and when the resource is disabled.
+func deletePushedImage(d *schema.ResourceData, meta interface{}) error {
+	if registryHost := d.Get("registry_host").(string); registryHost != "" {
+		log.Printf("[WARN] Images in %s are not deleted, only removing them from the state", registryHost)
+		return nil
+	}
+	opts := getAWSCallOptions(d, meta.(*Config))
+	repoName := d.Get("ecr_repository_name").(string)
+	imageTag := getEffectiveTag(d)
+	awsRegion := d.Get("aws_region").(string)
+	imageDigest := d.Get("image_digest").(string)
+	if err := checkExpectedAccount(opts, awsRegion, meta.(*Config)); err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := repoExists(opts, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if out != true {
+		log.Fatal("The provided ECR repository does not exist")
+	}
+
+	out, err = imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// A tag moved to another image out of band is left to its new owner
+	if out == true && imageDigest != "" {
+		tagDigest, err := getImageDigest(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image digest: ", err)
+		}
+		if tagDigest != imageDigest {
+			log.Printf("[WARN] Tag %s now resolves to %s, only deleting the pushed image %s", imageTag, tagDigest, imageDigest)
+			out = false
+		}
+	}
+	if out != true {
+		if imageDigest == "" {
+			log.Fatal("The provided Image tag does not exist in the repository")
+		}
+		fmt.Println("Image tag no longer points at the pushed image, deleting image by digest")
+		err = deleteImageByDigest(opts, repoName, imageDigest, awsRegion)
+		if err != nil {
+			log.Fatal("Error deleting Image", err)
+		}
+	} else {
+		fmt.Println("Deleting image")
+		err = deleteImage(opts, repoName, imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error deleting Image", err)
+		}
+	}
+
+	// Remove the secondary tags created alongside the image
+	secondaryTags := getVariantTags(d)
+	if digestTag := d.Get("digest_tag").(string); digestTag != "" {
+		secondaryTags = append(secondaryTags, digestTag)
+	}
+	for _, previousTag := range d.Get("previous_tags").([]interface{}) {
+		secondaryTags = append(secondaryTags, previousTag.(string))
+	}
+	for _, secondaryTag := range secondaryTags {
+		err = deleteTagIfExists(opts, repoName, secondaryTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error deleting tag ", secondaryTag, ": ", err)
+		}
+	}
+	// The commit tag can move to a later image built from the same commit
+	if gitCommitTag := d.Get("git_commit_tag").(string); gitCommitTag != "" {
+		err = deleteTagIfDigest(opts, repoName, gitCommitTag, imageDigest, awsRegion)
+		if err != nil {
+			log.Fatal("Error deleting tag ", gitCommitTag, ": ", err)
+		}
+	}
+	fmt.Println("Docker image successfully removed from ECR")
+
+	// Only repositories created by this resource are removed
+	if d.Get("delete_empty_repository").(bool) && d.Get("repository_created").(bool) {
+		if replacingChangedContent(d, opts) {
+			log.Printf("[WARN] The image content changed, keeping repository %s for the replacement", repoName)
+			return nil
+		}
+		remainingImages, err := listImageIds(opts, repoName, tagStatusAny, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(remainingImages) == 0 {
+			fmt.Println("Deleting empty ECR repository: ", repoName)
+			err = deleteRepository(opts, repoName, awsRegion)
+			if err != nil {
+				log.Fatal("Error deleting ECR repository: ", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// replacingChangedContent tells a destroy apart from the replacement a
+// changed build context plans, terraform deletes the same way for both. The
+// replacement pushes into the repository right after, so it has to stay.
+func replacingChangedContent(d *schema.ResourceData, opts awsCallOptions) bool {
+	contextRevision := d.Get("context_s3_revision").(string)
+	if contextS3Uri := d.Get("context_s3_uri").(string); contextS3Uri != "" {
+		var err error
+		contextRevision, err = getS3ObjectRevision(opts, contextS3Uri, d.Get("aws_region").(string))
+		if err != nil {
+			return false
+		}
+	}
+	contentHash, err := getContentHash(d, contextRevision)
+	return err == nil && contentHash != d.Get("content_hash").(string)
+}
+
+func resourcePushImageUpdate(d *schema.ResourceData, meta interface{}) error {
+	if d.HasChange("enabled") {
+		if d.Get("enabled").(bool) != true {
+			if err := deletePushedImage(d, meta); err != nil {
+				return err
+			}
+			d.SetId(disabledResourceId)
+			d.Set("image_pushed", false)
+			return nil
+		}
+		return resourcePushImageCreate(d, meta)
+	}
+	if d.Get("enabled").(bool) != true {
+		return nil
+	}
+	opts := getAWSCallOptions(d, meta.(*Config))
+	if d.Get("registry_host").(string) == "" {
+		if err := checkExpectedAccount(opts, d.Get("aws_region").(string), meta.(*Config)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if d.HasChange("repository_policy") {
+		repoName := d.Get("ecr_repository_name").(string)
+		awsRegion := d.Get("aws_region").(string)
+		var err error
+		if repositoryPolicy := d.Get("repository_policy").(string); repositoryPolicy != "" {
+			err = setRepositoryPolicy(opts, repoName, repositoryPolicy, awsRegion)
+		} else {
+			err = deleteRepositoryPolicy(opts, repoName, awsRegion)
+		}
+		if err != nil {
+			log.Fatal("Error updating ECR repository policy: ", err)
+		}
+	}
+	if lifecyclePolicy := d.Get("lifecycle_policy").(string); d.HasChange("lifecycle_policy") && lifecyclePolicy != "" {
+		err := putLifecyclePolicy(opts, d.Get("ecr_repository_name").(string), lifecyclePolicy, d.Get("aws_region").(string))
+		if err != nil {
+			log.Fatal("Error updating ECR lifecycle policy: ", err)
+		}
+	}
+	// Turning keep_previous_tag off removes the tags kept so far
+	if d.HasChange("keep_previous_tag") && d.Get("keep_previous_tag").(bool) != true {
+		repoName := d.Get("ecr_repository_name").(string)
+		awsRegion := d.Get("aws_region").(string)
+		for _, previousTag := range d.Get("previous_tags").([]interface{}) {
+			// A tag changed back to an earlier value is the live image again
+			if previousTag.(string) == getEffectiveTag(d) {
+				continue
+			}
+			err := deleteTagIfExists(opts, repoName, previousTag.(string), awsRegion)
+			if err != nil {
+				log.Fatal("Error deleting previous tag ", previousTag, ": ", err)
+			}
+		}
+		d.Set("previous_tags", []string{})
+	}
+	if d.HasChange("auto_git_tag") {
+		updateGitCommitTag(d, opts)
+	}
+	if d.HasChange("add_digest_tag") {
+		repoName := d.Get("ecr_repository_name").(string)
+		awsRegion := d.Get("aws_region").(string)
+		imageDigest := d.Get("image_digest").(string)
+		var err error
+		if d.Get("add_digest_tag").(bool) {
+			err = addDigestTag(opts, repoName, getEffectiveTag(d), imageDigest, awsRegion)
+		} else {
+			err = deleteTagIfDigest(opts, repoName, getDigestTag(imageDigest), imageDigest, awsRegion)
+		}
+		if err != nil {
+			log.Fatal("Error updating digest tag: ", err)
+		}
+	}
+	if d.HasChange("image_tag") && d.Get("registry_host").(string) != "" {
+		return updateRegistryImageTag(d, meta)
+	}
+	if d.HasChange("image_tag") {
+		repoName := d.Get("ecr_repository_name").(string)
+		oldVal, newVal := d.GetChange("image_tag")
+		oldTag := getEffectiveTag(d)
+		newTag := newVal.(string)
+		awsRegion := d.Get("aws_region").(string)
+
+		out, err := repoExists(opts, repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if out != true {
+			log.Fatal("The provided ECR repository does not exist")
+		}
+	
+		oldTagExists, err := imageTagExist(opts, oldTag, repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Without the old tag in ECR the image can still be re-pushed from the local build
+		localImage := fmt.Sprintf("%s:%s", getImageName(d), oldVal.(string))
+		if oldTagExists != true {
+			if d.Get("repush_missing_image").(bool) != true {
+				log.Fatal("The previous Image tag does not exist anymore in the repository, set repush_missing_image to push the local image again")
+			}
+			err = checkLocalImageDigest(opts, localImage, d.Get("last_pushed_digest").(string))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	
+		repoMutability, err := isTagMutable(opts, newTag, repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		newTagAlreadyExists, err := imageTagExist(opts, newTag, repoName, awsRegion) 
+		if err != nil {
+			log.Fatal(err)
+		}
+	
+		if newTagAlreadyExists == true && repoMutability == false && d.Get("on_immutable_conflict").(string) == "suffix" {
+			newTag = fmt.Sprintf("%s-%s", newTag, getShortDigest(d.Get("image_digest").(string)))
+			log.Printf("[WARN] Tag %s already exists in the immutable repository %s, using %s instead", newVal.(string), repoName, newTag)
+			newTagAlreadyExists, err = imageTagExist(opts, newTag, repoName, awsRegion)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if newTagAlreadyExists == true && repoMutability == false {
+			log.Fatal("The repositorie is immutable and you are trying to update an image with a tag that already exists in the repositorie")
+		}
+		d.Set("effective_tag", newTag)
+		d.Set("previous_manifest", "")
+		if newTagAlreadyExists == true {
+			checkTagOverwrite(d, newTag, repoName)
+			previousManifest, err := getImageManifest(opts, repoName, newTag, awsRegion)
+			if err != nil {
+				log.Fatal("Error retrieving the manifest behind tag ", newTag, ": ", err)
+			}
+			d.Set("previous_manifest", previousManifest)
+		}
+
+		if oldTagExists != true {
+			config := meta.(*Config)
+			_, ecrUriWithRepo, err := resolveRepositoryUri(opts, repoName, awsRegion, config)
+			if err != nil {
+				log.Fatal("Error retrieving ECR repository URI: ", err)
+			}
+			ecrUriWithTag, err := getPushUri(d, opts, config, ecrUriWithRepo, awsRegion, repoName, newTag)
+			if err != nil {
+				log.Fatal("Error building the push URI: ", err)
+			}
+			ecrUri := getUriHost(ecrUriWithTag)
+			fmt.Println("Previous Image tag not found in ECR, pushing the local image under the new tag")
+			err = tagDockerImage(opts, localImage, ecrUriWithTag)
+			if err != nil {
+				log.Fatal("Error tagging Docker image: ", err)
+			}
+			buildLog, closeBuildLog, err := openBuildLog(d)
+			if err != nil {
+				log.Fatal("Error opening build log: ", err)
+			}
+			defer closeBuildLog()
+			config.acquirePush()
+			pushStart := time.Now()
+			var pushOutput bytes.Buffer
+			_, err = pushResourceImage(opts, d, ecrUriWithTag, awsRegion, ecrUri, io.MultiWriter(buildLog, &pushOutput))
+			config.releasePush()
+			if err != nil {
+				log.Fatal("Error pushing Docker image: ", err)
+			}
+			d.Set("push_duration_seconds", time.Since(pushStart).Seconds())
+			layersPushed, layersReused := countPushedLayers(pushOutput.String())
+			d.Set("layers_pushed", layersPushed)
+			d.Set("layers_reused", layersReused)
+			imageDigest, err := getImageDigest(opts, repoName, newTag, awsRegion)
+			if err != nil {
+				log.Fatal("Error retrieving Image digest: ", err)
+			}
+			d.Set("last_pushed_digest", imageDigest)
+			d.Set("image_pushed", true)
+			return readPushImage(d, meta)
+		}
+
+		imageManifest, err := getImageManifest(opts, repoName, oldTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retriving Image digest", err)
+		}
+		err = updateImageTag(opts, imageManifest, repoName, newTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error updating Image Tag", err)
+		}
+		if d.Get("keep_previous_tag").(bool) {
+			d.Set("previous_tags", appendPreviousTag(d.Get("previous_tags").([]interface{}), oldTag, newTag))
+			return readPushImage(d, meta)
+		}
+		err = deleteImage(opts, repoName, oldTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error deleting the old image tag")
+		}
+	}
+	return readPushImage(d, meta)
+}
+
+// Manifest media types in the order they are preferred when a tag resolves
+// to more than one image, indexes before single platform manifests.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+func getImageManifest(opts awsCallOptions, repoName, imageTag, awsRegion string) (string, error) {
+
+	batchGetImageCMD := fmt.Sprintf("aws ecr batch-get-image --repository-name %s --image-ids imageTag=%s --query 'images[].{tag: imageId.imageTag, mediaType: imageManifestMediaType, manifest: imageManifest}' --output json --region %s", repoName, imageTag, awsRegion)
+	batchGetImage, cancel := opts.command("bash", "-c", batchGetImageCMD)
+	defer cancel()
+	out, err := batchGetImage.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return "", err
+	}
+	var images []struct {
+		Tag       string `json:"tag"`
+		MediaType string `json:"mediaType"`
+		Manifest  string `json:"manifest"`
+	}
+	if err := json.Unmarshal(out, &images); err != nil {
+		return "", err
+	}
+	var manifests []string
+	var mediaTypes []string
+	for _, image := range images {
+		if image.Tag == imageTag {
+			manifests = append(manifests, image.Manifest)
+			mediaTypes = append(mediaTypes, image.MediaType)
+		}
+	}
+	if len(manifests) == 0 {
+		return "", fmt.Errorf("No image found for tag %s in repository %s", imageTag, repoName)
+	}
+	for i, manifest := range manifests {
+		if strings.TrimSpace(manifest) == "" {
+			return "", fmt.Errorf("ECR returned an empty %s manifest for tag %s in repository %s", mediaTypes[i], imageTag, repoName)
+		}
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	for _, preferred := range manifestMediaTypes {
+		var selected []string
+		for i, mediaType := range mediaTypes {
+			if mediaType == preferred {
+				selected = append(selected, manifests[i])
+			}
+		}
+		if len(selected) == 1 {
+			return selected[0], nil
+		}
+		if len(selected) > 1 {
+			break
+		}
+	}
+	return "", fmt.Errorf("Tag %s in repository %s is ambiguous, it resolves to %d images with media types %s", imageTag, repoName, len(manifests), strings.Join(mediaTypes, ", "))
+}
+
+// getImageLayers lists the layers of the image manifest with their compressed
+// sizes. Of an image index the layers of its first platform manifest are listed.
+func getImageLayers(opts awsCallOptions, repoName, imageTag, awsRegion string) ([]map[string]interface{}, error) {
+	imageManifest, err := getImageManifest(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	imageManifest, err = getPlatformManifest(opts, repoName, imageManifest, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+			Size   int    `json:"size"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal([]byte(imageManifest), &manifest); err != nil {
+		return nil, err
+	}
+	layers := []map[string]interface{}{}
+	for _, layer := range manifest.Layers {
+		layers = append(layers, map[string]interface{}{
+			"digest": layer.Digest,
+			"size":   layer.Size,
+		})
+	}
+	return layers, nil
+}
+
+// getPlatformManifest returns the manifest of the first platform an image index
+// or manifest list references, like the single image of an annotated index.
+// Attestation manifests are skipped and any other manifest is returned as is.
+func getPlatformManifest(opts awsCallOptions, repoName, imageManifest, awsRegion string) (string, error) {
+	var index struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				Os string `json:"os"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal([]byte(imageManifest), &index); err != nil {
+		return "", err
+	}
+	for _, manifest := range index.Manifests {
+		if manifest.Platform.Os == "" || manifest.Platform.Os == "unknown" {
+			continue
+		}
+		batchGetImage, cancel := opts.command("aws", "ecr", "batch-get-image", "--repository-name", repoName, "--image-ids", "imageDigest="+manifest.Digest, "--query", "images[0].imageManifest", "--output", "text", "--region", awsRegion)
+		defer cancel()
+		out, err := batchGetImage.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return imageManifest, nil
+}
+
+// getScanFindings lists the findings of the latest scan of the image from
+// basic and enhanced scanning. An image that was never scanned has none.
+func getScanFindings(opts awsCallOptions, repoName, imageDigest, awsRegion string) ([]map[string]interface{}, error) {
+	describeFindings, cancel := opts.command("aws", "ecr", "describe-image-scan-findings", "--repository-name", repoName, "--image-id", "imageDigest="+imageDigest, "--output", "json", "--region", awsRegion)
+	defer cancel()
+	out, err := describeFindings.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && strings.Contains(string(exitErr.Stderr), "ScanNotFoundException") {
+			return []map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+	var result struct {
+		ImageScanFindings struct {
+			Findings []struct {
+				Name       string `json:"name"`
+				Severity   string `json:"severity"`
+				Uri        string `json:"uri"`
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+				} `json:"attributes"`
+			} `json:"findings"`
+			EnhancedFindings []struct {
+				Severity                    string `json:"severity"`
+				PackageVulnerabilityDetails struct {
+					VulnerabilityId    string `json:"vulnerabilityId"`
+					SourceUrl          string `json:"sourceUrl"`
+					VulnerablePackages []struct {
+						Name string `json:"name"`
+					} `json:"vulnerablePackages"`
+					Cvss []struct {
+						BaseScore float64 `json:"baseScore"`
+					} `json:"cvss"`
+				} `json:"packageVulnerabilityDetails"`
+			} `json:"enhancedFindings"`
+		} `json:"imageScanFindings"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+	scanFindings := []map[string]interface{}{}
+	for _, finding := range result.ImageScanFindings.Findings {
+		scanFinding := map[string]interface{}{
+			"name":     finding.Name,
+			"severity": finding.Severity,
+			"package":  "",
+			"cvss":     0.0,
+			"uri":      finding.Uri,
+		}
+		for _, attribute := range finding.Attributes {
+			switch attribute.Key {
+			case "package_name":
+				scanFinding["package"] = attribute.Value
+			case "CVSS3_SCORE", "CVSS2_SCORE":
+				var cvss float64
+				fmt.Sscanf(attribute.Value, "%g", &cvss)
+				if scanFinding["cvss"] == 0.0 {
+					scanFinding["cvss"] = cvss
+				}
+			}
+		}
+		scanFindings = append(scanFindings, scanFinding)
+	}
+	for _, finding := range result.ImageScanFindings.EnhancedFindings {
+		details := finding.PackageVulnerabilityDetails
+		scanFinding := map[string]interface{}{
+			"name":     details.VulnerabilityId,
+			"severity": finding.Severity,
+			"package":  "",
+			"cvss":     0.0,
+			"uri":      details.SourceUrl,
+		}
+		if len(details.VulnerablePackages) > 0 {
+			scanFinding["package"] = details.VulnerablePackages[0].Name
+		}
+		if len(details.Cvss) > 0 {
+			scanFinding["cvss"] = details.Cvss[0].BaseScore
+		}
+		scanFindings = append(scanFindings, scanFinding)
+	}
+	return scanFindings, nil
+}
+
+// getPlatformDigests maps the platforms of an image index or manifest list to
+// the digests of their manifests. A single platform image has no entries.
+func getPlatformDigests(opts awsCallOptions, repoName, imageTag, awsRegion string) (map[string]string, error) {
+	imageManifest, err := getImageManifest(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	var index struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				Architecture string `json:"architecture"`
+				Os           string `json:"os"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal([]byte(imageManifest), &index); err != nil {
+		return nil, err
+	}
+	platformDigests := map[string]string{}
+	for _, manifest := range index.Manifests {
+		// Attestation manifests of BuildKit are listed with an unknown platform
+		if manifest.Platform.Os == "" || manifest.Platform.Os == "unknown" {
+			continue
+		}
+		platform := fmt.Sprintf("%s/%s", manifest.Platform.Os, manifest.Platform.Architecture)
+		if manifest.Platform.Variant != "" {
+			platform = fmt.Sprintf("%s/%s", platform, manifest.Platform.Variant)
+		}
+		platformDigests[platform] = manifest.Digest
+	}
+	return platformDigests, nil
+}
+
+// Label carrying the content hash of images built with skip_unchanged_build.
+const contentHashLabel = "terraform-ecr-push-image.content-hash"
+
+// getUnchangedImageDigest returns the digest of the image behind the tag when
+// its content hash label matches, or an empty string.
+func getUnchangedImageDigest(opts awsCallOptions, repoName, imageTag, contentHash, awsRegion string) (string, error) {
+	tagExists, err := imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil || tagExists != true {
+		return "", err
+	}
+	imageConfig, err := getImageConfig(opts, repoName, imageTag, awsRegion)
+	if err != nil || imageConfig == nil || imageConfig.Config.Labels[contentHashLabel] != contentHash {
+		return "", err
+	}
+	return getImageDigest(opts, repoName, imageTag, awsRegion)
+}
+
+type imageConfig struct {
+	Architecture string `json:"architecture"`
+	Os           string `json:"os"`
+	Config       struct {
+		Labels       map[string]string   `json:"Labels"`
+		Env          []string            `json:"Env"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		User         string              `json:"User"`
+		WorkingDir   string              `json:"WorkingDir"`
+	} `json:"config"`
+}
+
+// getImageConfig downloads the config blob of the image behind the tag, of an
+// image index the config of its first platform manifest.
+func getImageConfig(opts awsCallOptions, repoName, imageTag, awsRegion string) (*imageConfig, error) {
+	imageManifest, err := getImageManifest(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	imageManifest, err = getPlatformManifest(opts, repoName, imageManifest, awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(imageManifest), &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config.Digest == "" {
+		return nil, nil
+	}
+	getDownloadUrl, cancel := opts.command("aws", "ecr", "get-download-url-for-layer", "--repository-name", repoName, "--layer-digest", manifest.Config.Digest, "--query", "downloadUrl", "--output", "text", "--region", awsRegion)
+	defer cancel()
+	out, err := getDownloadUrl.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	client, err := newHTTPClient(0, opts.caBundlePath())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Downloading the image config failed with status %s", resp.Status)
+	}
+	config := &imageConfig{}
+	if err := json.NewDecoder(resp.Body).Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func getImageDigest(opts awsCallOptions, repoName, imageTag, awsRegion string) (string, error) {
+	digestCMD := fmt.Sprintf("aws ecr describe-images --repository-name %s --image-ids imageTag=%s --query 'imageDetails[0].imageDigest' --output text --region %s", repoName, imageTag, awsRegion)
+	digest, cancel := opts.command("bash", "-c", digestCMD)
+	defer cancel()
+	out, err := digest.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func getAssociatedTags(opts awsCallOptions, repoName, imageDigest, awsRegion string) ([]string, error) {
+	describeImageCMD := fmt.Sprintf("aws ecr describe-images --repository-name %s --image-ids imageDigest=%s --query 'imageDetails[0].imageTags' --output json --region %s", repoName, imageDigest, awsRegion)
+	describeImage, cancel := opts.command("bash", "-c", describeImageCMD)
+	defer cancel()
+	out, err := describeImage.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return nil, err
+	}
+	var imageTags []string
+	if err := json.Unmarshal(out, &imageTags); err != nil {
+		return nil, err
+	}
+	return imageTags, nil
+}
+
+// getDigestTag derives the secondary sha-<short digest> tag of an image digest.
+func getDigestTag(imageDigest string) string {
+	return fmt.Sprintf("sha-%s", getShortDigest(imageDigest))
+}
+
+func getShortDigest(imageDigest string) string {
+	shortDigest := strings.TrimPrefix(imageDigest, "sha256:")
+	if len(shortDigest) > 12 {
+		shortDigest = shortDigest[:12]
+	}
+	return shortDigest
+}
+
+// updateGitCommitTag adds or removes the commit tag of the pushed image when
+// auto_git_tag is switched without a new push.
+func updateGitCommitTag(d *schema.ResourceData, opts awsCallOptions) {
+	repoName := d.Get("ecr_repository_name").(string)
+	awsRegion := d.Get("aws_region").(string)
+	if d.Get("auto_git_tag").(bool) != true {
+		if gitCommitTag := d.Get("git_commit_tag").(string); gitCommitTag != "" {
+			err := deleteTagIfDigest(opts, repoName, gitCommitTag, d.Get("image_digest").(string), awsRegion)
+			if err != nil {
+				log.Fatal("Error deleting tag ", gitCommitTag, ": ", err)
+			}
+		}
+		d.Set("git_commit_tag", "")
+		return
+	}
+	contextPath, _ := getBuildContext(d)
+	gitCommitTag, err := getGitShortSha(contextPath)
+	if err != nil && d.Get("auto_git_tag_strict").(bool) {
+		log.Fatal("Error reading the git commit for auto_git_tag: ", err)
+	}
+	if err != nil {
+		log.Printf("[WARN] Skipping auto_git_tag: %v", err)
+		return
+	}
+	imageManifest, err := getImageManifest(opts, repoName, getEffectiveTag(d), awsRegion)
+	if err != nil {
+		log.Fatal("Error retrieving Image manifest: ", err)
+	}
+	err = updateImageTag(opts, imageManifest, repoName, gitCommitTag, awsRegion)
+	if err != nil {
+		log.Fatal("Error adding git commit tag: ", err)
+	}
+	d.Set("git_commit_tag", gitCommitTag)
+}
+
+// appendPreviousTag adds the replaced tag to previous_tags and drops the new
+// tag, which is live again after changing back to an earlier value.
+func appendPreviousTag(previousTags []interface{}, oldTag, newTag string) []string {
+	tags := []string{}
+	for _, previousTag := range previousTags {
+		if previousTag.(string) != newTag && previousTag.(string) != oldTag {
+			tags = append(tags, previousTag.(string))
+		}
+	}
+	return append(tags, oldTag)
+}
+
+// getEffectiveTag returns the tag the image carries in ECR, which differs
+// from image_tag when an immutable conflict was resolved with a suffix.
+// States written before effective_tag existed fall back to the image_tag of
+// the state, during an update the new image_tag is not pushed yet.
+func getEffectiveTag(d resourceGetter) string {
+	if effectiveTag := d.Get("effective_tag").(string); effectiveTag != "" {
+		return effectiveTag
+	}
+	if changeGetter, ok := d.(interface {
+		GetChange(key string) (interface{}, interface{})
+	}); ok {
+		if oldTag, _ := changeGetter.GetChange("image_tag"); oldTag.(string) != "" {
+			return oldTag.(string)
+		}
+	}
+	return d.Get("image_tag").(string)
+}
+
+// resolveTagTemplate fills in the placeholders {timestamp}, {date}, {git_sha}
+// and {version} of tag_template. The git commit is read from the build context.
+func resolveTagTemplate(tagTemplate, version, contextPath string) (string, error) {
+	now := time.Now().UTC()
+	gitSha := ""
+	if strings.Contains(tagTemplate, "{git_sha}") {
+		var err error
+		gitSha, err = getGitShortSha(contextPath)
+		if err != nil {
+			return "", err
+		}
+	}
+	if strings.Contains(tagTemplate, "{version}") && version == "" {
+		return "", fmt.Errorf("tag_template %s uses {version} but tag_version is not set", tagTemplate)
+	}
+	imageTag := strings.NewReplacer("{timestamp}", now.Format("20060102150405"), "{date}", now.Format("20060102"), "{git_sha}", gitSha, "{version}", version).Replace(tagTemplate)
+	if imageTagRegexp.MatchString(imageTag) != true {
+		return "", fmt.Errorf("tag_template %s resolves to %s, which is not a valid image tag", tagTemplate, imageTag)
+	}
+	return imageTag, nil
+}
+
+func getGitShortSha(contextPath string) (string, error) {
+	workDir := contextPath
+	if info, err := os.Stat(contextPath); err == nil && !info.IsDir() {
+		workDir = filepath.Dir(contextPath)
+	}
+	revParse := exec.Command("git", "rev-parse", "--short", "HEAD")
+	revParse.Dir = workDir
+	out, err := revParse.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("unable to read the git commit of %s: %s", workDir, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func addDigestTag(opts awsCallOptions, repoName, imageTag, imageDigest, awsRegion string) error {
+	digestTag := getDigestTag(imageDigest)
+	tagExists, err := imageTagExist(opts, digestTag, repoName, awsRegion)
+	if err != nil {
+		return err
+	}
+	// The tag is derived from the digest, so an existing one already points at this image
+	if tagExists == true {
+		return nil
+	}
+	imageManifest, err := getImageManifest(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		return err
+	}
+	return updateImageTag(opts, imageManifest, repoName, digestTag, awsRegion)
+}
+
+// Errors of PutImage that go away when the call is repeated later.
+var retryablePutImageErrors = []string{
+	"ThrottlingException",
+	"Rate exceeded",
+	"LimitExceededException",
+	"ServerException",
+	"ServiceUnavailable",
+}
+
+const putImageAttempts = 5
+
+// updateImageTag puts the manifest under the new tag, retrying transient
+// failures with exponential backoff. ImageAlreadyExistsException means the tag
+// already points at this manifest, which makes repeating a tag move a no-op.
+func updateImageTag(opts awsCallOptions, imageManifest, repoName, newImageTag, awsRegion string) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		// The manifest is passed as is, an index carries user supplied annotations
+		updateTag, cancel := opts.command("aws", "ecr", "put-image", "--repository-name", repoName, "--image-tag", newImageTag, "--image-manifest", imageManifest, "--region", awsRegion)
+		out, err := updateTag.CombinedOutput()
+		cancel()
+		if err == nil || strings.Contains(string(out), "ImageAlreadyExistsException") {
+			return nil
+		}
+		if attempt == putImageAttempts || putImageRetryable(out) != true {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		log.Printf("[WARN] PutImage for tag %s failed, retrying in %s: %s", newImageTag, backoff, strings.TrimSpace(string(out)))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func putImageRetryable(out []byte) bool {
+	for _, message := range retryablePutImageErrors {
+		if strings.Contains(string(out), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAWSAccountID returns the account the credentials belong to, asking
+// STS in the credentials region and falling back to the region of the resource.
+// It fails when the account differs from the expected_account_id of the provider.
+func resolveAWSAccountID(opts awsCallOptions, awsRegion string, config *Config) (string, error) {
+	credentialsRegion := config.credentialsRegion
+	if credentialsRegion == "" {
+		credentialsRegion = awsRegion
+	}
+	awsAccountId, err := getAWSAccountID(opts, credentialsRegion)
+	if err != nil {
+		return "", err
+	}
+	if config.expectedAccountId != "" && awsAccountId != config.expectedAccountId {
+		return "", fmt.Errorf("The credentials belong to AWS account %s but expected_account_id is %s, check the configured profile or role", awsAccountId, config.expectedAccountId)
+	}
+	return awsAccountId, nil
+}
+
+// checkExpectedAccount fails before anything is changed when the credentials
+// do not belong to the expected_account_id of the provider.
+func checkExpectedAccount(opts awsCallOptions, awsRegion string, config *Config) error {
+	if config.expectedAccountId == "" {
+		return nil
+	}
+	_, err := resolveAWSAccountID(opts, awsRegion, config)
+	return err
+}
+
+// resolveRepositoryUri returns the registry host and the repository URI as
+// reported by ECR, which already accounts for FIPS, dualstack and shared
+// registries. The URI is only built from the account Id if ECR returns none.
+func resolveRepositoryUri(opts awsCallOptions, repoName, awsRegion string, config *Config) (string, string, error) {
+	repositoryUri, err := getRepositoryUri(opts, repoName, awsRegion)
+	if err != nil {
+		return "", "", err
+	}
+	if repositoryUri == "" {
+		awsAccountId, err := resolveAWSAccountID(opts, awsRegion, config)
+		if err != nil {
+			return "", "", err
+		}
+		repositoryUri = fmt.Sprintf("%s/%s", getEcrUri(awsAccountId, awsRegion), repoName)
+	}
+	if config.useDualstackEndpoint {
+		repositoryUri = getDualstackUri(repositoryUri)
+	}
+	return strings.SplitN(repositoryUri, "/", 2)[0], repositoryUri, nil
+}
+
+// getPushUri returns the URI a tag is pushed to, the repository URI of ECR
+// or the uri_template of the provider with its placeholders filled in.
+func getPushUri(d resourceGetter, opts awsCallOptions, config *Config, ecrUriWithRepo, awsRegion, repoName, imageTag string) (string, error) {
+	if config.uriTemplate == "" {
+		return overrideUriHost(fmt.Sprintf("%s:%s", ecrUriWithRepo, imageTag), d.Get("registry_endpoint_override").(string)), nil
+	}
+	awsAccountId := ""
+	if strings.Contains(config.uriTemplate, "{account}") {
+		var err error
+		awsAccountId, err = resolveAWSAccountID(opts, awsRegion, config)
+		if err != nil {
+			return "", err
+		}
+	}
+	uri := strings.NewReplacer("{account}", awsAccountId, "{region}", awsRegion, "{repo}", repoName, "{tag}", imageTag).Replace(config.uriTemplate)
+	return overrideUriHost(uri, d.Get("registry_endpoint_override").(string)), nil
+}
+
+// overrideUriHost swaps the registry host of the uri, e.g. for the DNS name of
+// a PrivateLink endpoint. The aws CLI calls keep their regional endpoint.
+func overrideUriHost(uri, host string) string {
+	if host == "" {
+		return uri
+	}
+	return strings.TrimSuffix(host, "/") + strings.TrimPrefix(uri, getUriHost(uri))
+}
+
+func getUriHost(uri string) string {
+	return strings.SplitN(uri, "/", 2)[0]
+}
+
+// getDualstackUri moves an ECR URI to the dualstack registry host,
+// <account>.dkr-ecr.<region>.on.aws instead of <account>.dkr.ecr.<region>.amazonaws.com.
+func getDualstackUri(ecrUri string) string {
+	host, path := ecrUri, ""
+	if i := strings.Index(ecrUri, "/"); i >= 0 {
+		host, path = ecrUri[:i], ecrUri[i:]
+	}
+	if strings.Contains(host, ".dkr.ecr.") && strings.HasSuffix(host, ".amazonaws.com") {
+		host = strings.Replace(host, ".dkr.ecr.", ".dkr-ecr.", 1)
+		host = strings.TrimSuffix(host, ".amazonaws.com") + ".on.aws"
+	}
+	return host + path
+}
+
+func getRepositoryUri(opts awsCallOptions, repoName, awsRegion string) (string, error) {
+	describeRepo, cancel := opts.command("aws", "ecr", "describe-repositories", "--repository-names", repoName, "--query", "repositories[0].repositoryUri", "--output", "text", "--region", awsRegion)
+	defer cancel()
+	out, err := describeRepo.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	repositoryUri := strings.TrimSpace(string(out))
+	if repositoryUri == "None" {
+		return "", nil
+	}
+	return repositoryUri, nil
+}
+
+func getEcrUri(awsAccountId, awsRegion string) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", awsAccountId, awsRegion)
+}
+
+const getCallerIdentityAttempts = 4
+
+// getAWSAccountID asks STS for the account of the credentials, retrying when
+// the call is throttled.
+func getAWSAccountID(opts awsCallOptions, credentialsRegion string) (string, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		getAccountIdCMD, cancel := opts.command("aws", "sts", "get-caller-identity", "--query", "Account", "--output", "text", "--region", credentialsRegion)
+		accountId, err := getAccountIdCMD.CombinedOutput()
+		cancel()
+		if err == nil {
+			accountIdTrimmed := strings.TrimSpace(string(accountId))
+			return accountIdTrimmed, nil
+		}
+		throttled := strings.Contains(string(accountId), "Throttling") || strings.Contains(string(accountId), "Rate exceeded")
+		if attempt == getCallerIdentityAttempts || throttled != true {
+			return "", callerIdentityError(accountId, err)
+		}
+		log.Printf("[WARN] STS GetCallerIdentity was throttled, retrying in %s", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// callerIdentityError tells apart the usual reasons for GetCallerIdentity to fail.
+func callerIdentityError(out []byte, err error) error {
+	message := strings.TrimSpace(string(out))
+	switch {
+	case strings.Contains(message, "ExpiredToken") || strings.Contains(message, "expired"):
+		return fmt.Errorf("The AWS credentials have expired, refresh the session or profile: %s", message)
+	case strings.Contains(message, "Unable to locate credentials"):
+		return fmt.Errorf("No AWS credentials were found, configure a profile, environment variables or the provider credentials: %s", message)
+	case strings.Contains(message, "InvalidClientTokenId") || strings.Contains(message, "SignatureDoesNotMatch"):
+		return fmt.Errorf("The AWS credentials are invalid: %s", message)
+	case strings.Contains(message, "AccessDenied"):
+		return fmt.Errorf("The AWS credentials are not allowed to call sts:GetCallerIdentity: %s", message)
+	case strings.Contains(message, "Could not connect to the endpoint URL") || strings.Contains(message, "Connect timeout") || strings.Contains(message, "Read timeout"):
+		return fmt.Errorf("STS could not be reached, check the network and proxy settings: %s", message)
+	}
+	return fmt.Errorf("%v: %s", err, message)
+}
+
+// Resource limits accepted by docker build --ulimit.
+var knownUlimits = []string{
+	"core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue", "nice",
+	"nofile", "nproc", "rss", "rtprio", "rttime", "sigpending", "stack",
+}
+
+func getVariantTags(d resourceGetter) []string {
+	var variantTags []string
+	for _, raw := range d.Get("variants").([]interface{}) {
+		variantTags = append(variantTags, raw.(map[string]interface{})["tag"].(string))
+	}
+	return variantTags
+}
+
+// checkVariantTags rejects variants that would push over the image or over
+// each other, the last push would win and delete would remove the tag twice.
+func checkVariantTags(d resourceGetter) error {
+	imageTag := d.Get("image_tag").(string)
+	seen := map[string]bool{}
+	for _, variantTag := range getVariantTags(d) {
+		// Unknown until apply
+		if variantTag == "" {
+			continue
+		}
+		if variantTag == imageTag {
+			return fmt.Errorf("The variant tag %s is the image_tag of the resource", variantTag)
+		}
+		if seen[variantTag] {
+			return fmt.Errorf("The variant tag %s is used by more than one variant", variantTag)
+		}
+		seen[variantTag] = true
+	}
+	return nil
+}
+
+func getVariantBuildFlags(variant map[string]interface{}) []string {
+	var buildFlags []string
+	buildArgs := variant["build_args"].(map[string]interface{})
+	buildArgNames := make([]string, 0, len(buildArgs))
+	for name := range buildArgs {
+		buildArgNames = append(buildArgNames, name)
+	}
+	sort.Strings(buildArgNames)
+	for _, name := range buildArgNames {
+		buildFlags = append(buildFlags, "--build-arg", fmt.Sprintf("%s=%s", name, buildArgs[name]))
+	}
+	if target := variant["target"].(string); target != "" {
+		buildFlags = append(buildFlags, "--target", target)
+	}
+	return buildFlags
+}
+
+// getAnnotationFlags turns the annotations into --annotation flags ordered by key.
+func getAnnotationFlags(d resourceGetter) []string {
+	var annotationFlags []string
+	annotations := d.Get("annotations").(map[string]interface{})
+	annotationKeys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		annotationKeys = append(annotationKeys, key)
+	}
+	sort.Strings(annotationKeys)
+	for _, key := range annotationKeys {
+		annotationFlags = append(annotationFlags, "--annotation", fmt.Sprintf("index:%s=%s", key, annotations[key]))
+	}
+	return annotationFlags
+}
+
+// getResourceId is the image digest, followed by the digests of all variants
+// ordered by tag when variants are configured.
+func getResourceId(imageDigest string, variantDigests map[string]string) string {
+	variantTags := make([]string, 0, len(variantDigests))
+	for variantTag := range variantDigests {
+		variantTags = append(variantTags, variantTag)
+	}
+	sort.Strings(variantTags)
+	resourceId := imageDigest
+	for _, variantTag := range variantTags {
+		resourceId = fmt.Sprintf("%s,%s", resourceId, variantDigests[variantTag])
+	}
+	return resourceId
+}
+
+// getImageName returns the local image name, which defaults to the repository name.
+func getImageName(d *schema.ResourceData) string {
+	if imageName := d.Get("image_name").(string); imageName != "" {
+		if d.Get("normalize_image_name").(bool) {
+			return strings.ToLower(imageName)
+		}
+		return imageName
+	}
+	return d.Get("ecr_repository_name").(string)
+}
+
+// getBuildContext returns the build context directory and the Dockerfile to
+// build. Without context_path, dockerfile_path is the context directory and
+// holds the Dockerfile, otherwise it is the Dockerfile relative to the context.
+func getBuildContext(d resourceGetter) (string, string) {
+	// A prebuilt tarball is streamed as is and carries its own Dockerfile
+	if contextTarballPath := d.Get("context_tarball_path").(string); contextTarballPath != "" {
+		return contextTarballPath, ""
+	}
+	dockerfilePath := d.Get("dockerfile_path").(string)
+	contextPath := d.Get("context_path").(string)
+	// The inline Dockerfile is written to a temporary file at build time
+	if d.Get("dockerfile_content").(string) != "" {
+		return contextPath, ""
+	}
+	if contextPath == "" {
+		return dockerfilePath, ""
+	}
+	if dockerfilePath == "." {
+		dockerfilePath = "Dockerfile"
+	}
+	return contextPath, filepath.Join(contextPath, dockerfilePath)
+}
+
+func getBuildFlags(d *schema.ResourceData, config *Config) []string {
+	buildFlags := getUlimitFlags(d)
+	for _, extraHost := range d.Get("extra_hosts").([]interface{}) {
+		buildFlags = append(buildFlags, "--add-host", extraHost.(string))
+	}
+	if d.Get("keep_intermediate").(bool) {
+		buildFlags = append(buildFlags, "--rm=false", "--force-rm=false")
+	}
+	for _, cacheFrom := range d.Get("cache_from").([]interface{}) {
+		buildFlags = append(buildFlags, "--cache-from", cacheFrom.(string))
+	}
+	if d.Get("proxy_build_args").(bool) {
+		buildFlags = append(buildFlags, getProxyBuildArgs(config)...)
+	}
+	return buildFlags
+}
+
+func getUlimitFlags(d resourceGetter) []string {
+	var ulimitFlags []string
+	for _, raw := range d.Get("build_ulimits").([]interface{}) {
+		ulimit := raw.(map[string]interface{})
+		ulimitFlags = append(ulimitFlags, "--ulimit", fmt.Sprintf("%s=%d:%d", ulimit["name"], ulimit["soft"], ulimit["hard"]))
+	}
+	return ulimitFlags
+}
+
+// getProxyBuildArgs passes the proxy settings of the provider to the build in
+// both spellings. Docker predefines these args, so the Dockerfile needs no ARG
+// and the values stay out of the image history.
+func getProxyBuildArgs(config *Config) []string {
+	var buildArgs []string
+	for _, proxy := range []struct{ name, value string }{
+		{"HTTP_PROXY", config.httpProxy},
+		{"HTTPS_PROXY", config.httpsProxy},
+		{"NO_PROXY", config.noProxy},
+	} {
+		if proxy.value == "" {
+			continue
+		}
+		buildArgs = append(buildArgs, "--build-arg", fmt.Sprintf("%s=%s", proxy.name, proxy.value), "--build-arg", fmt.Sprintf("%s=%s", strings.ToLower(proxy.name), proxy.value))
+	}
+	return buildArgs
+}
+
+func splitS3Uri(s3Uri string) (string, string) {
+	bucketAndKey := strings.SplitN(strings.TrimPrefix(s3Uri, "s3://"), "/", 2)
+	if len(bucketAndKey) != 2 {
+		return bucketAndKey[0], ""
+	}
+	return bucketAndKey[0], bucketAndKey[1]
+}
+
+// getS3ObjectRevision returns the version id of the object, or its ETag when
+// the bucket is not versioned.
+func getS3ObjectRevision(opts awsCallOptions, s3Uri, awsRegion string) (string, error) {
+	bucket, key := splitS3Uri(s3Uri)
+	headObject, cancel := opts.command("aws", "s3api", "head-object", "--bucket", bucket, "--key", key, "--query", "{etag: ETag, version: VersionId}", "--output", "json", "--region", awsRegion)
+	defer cancel()
+	out, err := headObject.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return "", err
+	}
+	var response struct {
+		ETag    string `json:"etag"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(out, &response); err != nil {
+		return "", err
+	}
+	if response.Version != "" {
+		return response.Version, nil
+	}
+	return strings.Trim(response.ETag, `"`), nil
+}
+
+func downloadS3Object(opts awsCallOptions, s3Uri, awsRegion string) (string, error) {
+	archive, err := os.CreateTemp("", "build-context-*.tar")
+	if err != nil {
+		return "", err
+	}
+	archive.Close()
+	copyObject := opts.toolCommand("aws", "s3", "cp", s3Uri, archive.Name(), "--region", awsRegion)
+	out, err := copyObject.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		os.Remove(archive.Name())
+		return "", err
+	}
+	return archive.Name(), nil
+}
+
+// validateImageName accepts uppercase letters, which normalize_image_name
+// lowercases and the plan rejects otherwise.
+func validateImageName(v interface{}, k string) ([]string, []error) {
+	if imageNameRegexp.MatchString(strings.ToLower(v.(string))) != true {
+		return nil, []error{fmt.Errorf("%q must be a valid Docker image name: lowercase letters, digits and separators (., _, __, -) in slash separated components, optionally prefixed by a registry host, got %q", k, v)}
+	}
+	return nil, nil
+}
+
+func validateImageTag(v interface{}, k string) ([]string, []error) {
+	if strings.Contains(v.(string), "@sha256:") || strings.HasPrefix(v.(string), "sha256:") {
+		return nil, []error{fmt.Errorf("%q must be a tag, not a digest reference, got %q. The pushed digest is exported as image_digest, reference the image by digest through it", k, v)}
+	}
+	return nil, nil
+}
+
+// validateExtraHost accepts host:ip entries, where ip may also be the special
+// host-gateway value that docker resolves to the IP of the host.
+func validateExtraHost(v interface{}, k string) ([]string, []error) {
+	hostAndAddress := strings.SplitN(v.(string), ":", 2)
+	if len(hostAndAddress) != 2 || hostAndAddress[0] == "" {
+		return nil, []error{fmt.Errorf("%q must have the form host:ip, got %q", k, v)}
+	}
+	if hostAndAddress[1] != "host-gateway" && net.ParseIP(hostAndAddress[1]) == nil {
+		return nil, []error{fmt.Errorf("%q must map %s to an IP address or host-gateway, got %q", k, hostAndAddress[0], hostAndAddress[1])}
+	}
+	return nil, nil
+}
+
+// runPreBuildCommand runs the user supplied command in the build context.
+// The command only sees PATH and HOME, so the provider credentials and
+// settings are not passed on.
+func runPreBuildCommand(command, contextPath string) error {
+	workDir := contextPath
+	if info, err := os.Stat(contextPath); err == nil && !info.IsDir() {
+		workDir = filepath.Dir(contextPath)
+	}
+	preBuild := exec.Command("bash", "-c", command)
+	preBuild.Dir = workDir
+	preBuild.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + os.Getenv("HOME")}
+	out, err := preBuild.CombinedOutput()
+	log.Printf("[INFO] pre_build_command output:\n%s", out)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writeInlineDockerfile stores dockerfile_content in a temporary file. The
+// docker CLI adds a Dockerfile from outside the context directory to the
+// context under a generated name.
+func writeInlineDockerfile(dockerfileContent string) (string, error) {
+	dockerfile, err := os.CreateTemp("", "Dockerfile-*")
+	if err != nil {
+		return "", err
+	}
+	defer dockerfile.Close()
+	if _, err := dockerfile.WriteString(dockerfileContent); err != nil {
+		os.Remove(dockerfile.Name())
+		return "", err
+	}
+	return dockerfile.Name(), nil
+}
+
+func buildDockerImage(opts awsCallOptions, imageNameAndTag, contextPath, dockerfile, builder, dockerConfigDir string, buildFlags []string, buildLog io.Writer) error {
+	cmdArgs := dockerConfigArgs(dockerConfigDir)
+	if builder != "" {
+		// Named builders only exist for buildx, --load keeps the image in the local store for tagging
+		cmdArgs = append(cmdArgs, "buildx", "build", "--builder", builder, "--load")
+	} else {
+		cmdArgs = append(cmdArgs, "build")
+	}
+	cmdArgs = append(cmdArgs, "-t", imageNameAndTag)
+	cmdArgs = append(cmdArgs, buildFlags...)
+	if dockerfile != "" {
+		cmdArgs = append(cmdArgs, "-f", dockerfile)
+	}
+	// A regular file as context is a tar archive which docker reads from stdin
+	contextArchive := ""
+	if info, err := os.Stat(contextPath); err == nil && info.Mode().IsRegular() {
+		contextArchive = contextPath
+		contextPath = "-"
+	}
+	cmdArgs = append(cmdArgs, contextPath)
+	out, err := runDockerBuild(opts, cmdArgs, contextArchive)
+	buildLog.Write(out)
+	if err != nil && daemonConnectionLost(out) && remoteDockerHost() {
+		fmt.Println("Connection to the remote Docker daemon was lost, retrying the build once")
+		out, err = runDockerBuild(opts, cmdArgs, contextArchive)
+		buildLog.Write(out)
+	}
+	if err != nil {
+		fmt.Println(string(out))
+		fmt.Fprintln(buildLog, err)
+		if daemonConnectionLost(out) {
+			return fmt.Errorf("The connection to the Docker daemon was lost during the build, check that the daemon is running and reachable: %v", err)
+		}
+		return parseBuildError(out, err)
+	}
+	return nil
+}
+
+// pushWithProvenance builds the image and pushes it straight to the registry
+// together with its provenance attestation, which the local image store would
+// drop. The registry login has to be in the docker_config_dir. It returns the
+// digest buildx reports for the pushed image.
+func pushWithProvenance(opts awsCallOptions, ecrUriWithTag, contextPath, dockerfile, builder, provenance, dockerConfigDir string, buildFlags []string, buildLog io.Writer) (string, error) {
+	metadataFile, err := os.CreateTemp("", "buildx-metadata-*.json")
+	if err != nil {
+		return "", err
+	}
+	metadataFile.Close()
+	defer os.Remove(metadataFile.Name())
+	cmdArgs := append(dockerConfigArgs(dockerConfigDir), "buildx", "build", "--push", "--provenance", provenance, "--metadata-file", metadataFile.Name(), "-t", ecrUriWithTag)
+	if builder != "" {
+		cmdArgs = append(cmdArgs, "--builder", builder)
+	}
+	cmdArgs = append(cmdArgs, buildFlags...)
+	if dockerfile != "" {
+		cmdArgs = append(cmdArgs, "-f", dockerfile)
+	}
+	contextArchive := ""
+	if info, err := os.Stat(contextPath); err == nil && info.Mode().IsRegular() {
+		contextArchive = contextPath
+		contextPath = "-"
+	}
+	cmdArgs = append(cmdArgs, contextPath)
+	out, err := runDockerBuild(opts, cmdArgs, contextArchive)
+	buildLog.Write(out)
+	if err != nil {
+		fmt.Println(string(out))
+		fmt.Fprintln(buildLog, err)
+		return "", parseBuildError(out, err)
+	}
+	metadata, err := os.ReadFile(metadataFile.Name())
+	if err != nil {
+		return "", err
+	}
+	var buildMetadata struct {
+		ImageDigest string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal(metadata, &buildMetadata); err != nil {
+		return "", fmt.Errorf("Error reading the buildx metadata: %v", err)
+	}
+	return buildMetadata.ImageDigest, nil
+}
+
+// bakeDockerImage builds a target of a buildx bake definition into the local
+// image store under imageNameAndTag, from where it is tagged and pushed like
+// any other build. The contexts and Dockerfile come from the bake file.
+func bakeDockerImage(opts awsCallOptions, imageNameAndTag, bakeFile, bakeTarget, builder, dockerConfigDir string, buildLog io.Writer) error {
+	// Relative contexts in the bake file resolve against its directory
+	cmdArgs := append(dockerConfigArgs(dockerConfigDir), "buildx", "bake", "-f", filepath.Base(bakeFile), "--load", "--set", fmt.Sprintf("%s.tags=%s", bakeTarget, imageNameAndTag))
+	if builder != "" {
+		cmdArgs = append(cmdArgs, "--builder", builder)
+	}
+	cmdArgs = append(cmdArgs, bakeTarget)
+	bake := opts.toolCommand("docker", cmdArgs...)
+	bake.Dir = filepath.Dir(bakeFile)
+	out, err := bake.CombinedOutput()
+	buildLog.Write(out)
+	if err != nil {
+		fmt.Println(string(out))
+		fmt.Fprintln(buildLog, err)
+		return parseBuildError(out, err)
+	}
+	return nil
+}
+
+// dockerConfigArgs points the docker CLI at the docker_config_dir, whose
+// credentials are used to pull the base images during the build. Named
+// buildx builders are looked up in that directory as well.
+func dockerConfigArgs(dockerConfigDir string) []string {
+	if dockerConfigDir == "" {
+		return []string{}
+	}
+	return []string{"--config", dockerConfigDir}
+}
+
+// openBuildLog truncates the build_log_path file for this apply. Without a
+// path the build and push output is only printed.
+func openBuildLog(d *schema.ResourceData) (io.Writer, func(), error) {
+	buildLogPath := d.Get("build_log_path").(string)
+	if buildLogPath == "" {
+		return io.Discard, func() {}, nil
+	}
+	buildLog, err := os.Create(buildLogPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buildLog, func() { buildLog.Close() }, nil
+}
+
+// annotateImage replaces the pushed tag with an OCI index that carries the
+// annotations and points at the pushed manifest. The image store docker
+// pushes from keeps no annotations, so they are added in the registry.
+func annotateImage(opts awsCallOptions, ecrUriWithTag string, annotationFlags []string) error {
+	cmdArgs := []string{"buildx", "imagetools", "create", "-t", ecrUriWithTag}
+	cmdArgs = append(cmdArgs, annotationFlags...)
+	cmdArgs = append(cmdArgs, ecrUriWithTag)
+	annotate := opts.toolCommand("docker", cmdArgs...)
+	out, err := annotate.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func runDockerBuild(opts awsCallOptions, cmdArgs []string, contextArchive string) ([]byte, error) {
+	dockerBuildImage := opts.toolCommand("docker", cmdArgs...)
+	if contextArchive != "" {
+		archive, err := os.Open(contextArchive)
+		if err != nil {
+			return nil, err
+		}
+		defer archive.Close()
+		dockerBuildImage.Stdin = archive
+	}
+	return dockerBuildImage.CombinedOutput()
+}
+
+// Output fragments of the docker CLI when the daemon stream ends mid-build
+// instead of the build itself failing.
+var daemonConnectionErrors = []string{
+	"Cannot connect to the Docker daemon",
+	"error during connect",
+	"unexpected EOF",
+	"connection reset by peer",
+	"broken pipe",
+}
+
+// daemonConnectionLost only looks at the error the docker client ends with,
+// the same messages in the output of a build step are not the connection.
+func daemonConnectionLost(out []byte) bool {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	clientError := lines[len(lines)-1]
+	// A failing build step ends with its exit code whatever it printed
+	if strings.Contains(clientError, "did not complete successfully") || strings.Contains(clientError, "returned a non-zero code") {
+		return false
+	}
+	for _, message := range daemonConnectionErrors {
+		if strings.Contains(clientError, message) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteDockerHost() bool {
+	dockerHost := os.Getenv("DOCKER_HOST")
+	return dockerHost != "" && !strings.HasPrefix(dockerHost, "unix://") && !strings.HasPrefix(dockerHost, "npipe://")
+}
+
+// getBuildkitFeatures lists the configured attributes that only work with BuildKit.
+func getBuildkitFeatures(d *schema.ResourceData) []string {
+	var features []string
+	if d.Get("builder").(string) != "" {
+		features = append(features, "builder")
+	}
+	if len(d.Get("annotations").(map[string]interface{})) > 0 {
+		features = append(features, "annotations")
+	}
+	if d.Get("provenance").(string) != "false" {
+		features = append(features, "provenance")
+	}
+	return features
+}
+
+// buildkitInstructionFlags are the instruction flags the classic builder rejects.
+var buildkitInstructionFlags = map[string][]string{
+	"RUN":  {"--mount", "--network", "--security"},
+	"COPY": {"--link", "--parents", "--exclude"},
+	"ADD":  {"--link", "--parents", "--exclude", "--checksum", "--keep-git-dir"},
+}
+
+// getDockerfileBuildkitFeatures lists the instructions of the Dockerfile only
+// BuildKit can build, like RUN --mount for secrets, ssh and caches or heredocs.
+// Unlike the BuildKit-only attributes they cannot be left out of a classic
+// build. Dockerfiles inside a tarball or S3 context are not checked.
+func getDockerfileBuildkitFeatures(d resourceGetter) []string {
+	content := []byte(d.Get("dockerfile_content").(string))
+	if len(content) == 0 {
+		if d.Get("context_s3_uri").(string) != "" || d.Get("context_tarball_path").(string) != "" || d.Get("bake_file").(string) != "" {
+			return nil
+		}
+		contextPath, dockerfile := getBuildContext(d)
+		if dockerfile == "" {
+			dockerfile = filepath.Join(contextPath, "Dockerfile")
+		}
+		var err error
+		content, err = os.ReadFile(dockerfile)
+		if err != nil {
+			return nil
+		}
+	}
+	var features []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		instruction := strings.ToUpper(fields[0])
+		for _, field := range fields[1:] {
+			feature := ""
+			if strings.HasPrefix(field, "<<") && (instruction == "RUN" || instruction == "COPY") {
+				feature = instruction + " heredoc"
+			} else if strings.HasPrefix(field, "--") != true {
+				break
+			}
+			for _, flag := range buildkitInstructionFlags[instruction] {
+				if field == flag || strings.HasPrefix(field, flag+"=") {
+					feature = instruction + " " + flag
+				}
+			}
+			if feature != "" && seen[feature] != true {
+				seen[feature] = true
+				features = append(features, feature)
+			}
+		}
+	}
+	return features
+}
+
+// buildkitAvailable checks for the buildx CLI plugin and a daemon recent
+// enough to run BuildKit builds.
+func buildkitAvailable(opts awsCallOptions) error {
+	buildxVersion := opts.toolCommand("docker", "buildx", "version")
+	out, err := buildxVersion.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker buildx is not installed: %s", strings.TrimSpace(string(out)))
+	}
+	daemonVersion := opts.toolCommand("docker", "version", "--format", "{{.Server.Version}}")
+	out, err = daemonVersion.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to determine the Docker daemon version: %s", strings.TrimSpace(string(out)))
+	}
+	var major, minor int
+	fmt.Sscanf(strings.TrimSpace(string(out)), "%d.%d", &major, &minor)
+	if major < 18 || (major == 18 && minor < 9) {
+		return fmt.Errorf("Docker daemon %s is older than 18.09", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// builderExists looks the builder up in the docker_config_dir the build uses.
+func builderExists(opts awsCallOptions, builder, dockerConfigDir string) error {
+	inspectBuilder := opts.toolCommand("docker", append(dockerConfigArgs(dockerConfigDir), "buildx", "inspect", builder)...)
+	out, err := inspectBuilder.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return fmt.Errorf("The buildx builder %s does not exist: %v", builder, err)
+	}
+	return nil
+}
+
+func localImageExists(opts awsCallOptions, imageNameAndTag string) bool {
+	inspectImage := opts.toolCommand("docker", "image", "inspect", imageNameAndTag)
+	return inspectImage.Run() == nil
+}
+
+// checkLocalImageDigest makes sure the local image is the one last pushed, a
+// rebuild since then would push content the plan never showed.
+func checkLocalImageDigest(opts awsCallOptions, imageNameAndTag, pushedDigest string) error {
+	inspectImage := opts.toolCommand("docker", "image", "inspect", "--format", "{{json .RepoDigests}}", imageNameAndTag)
+	out, err := inspectImage.Output()
+	if err != nil {
+		return fmt.Errorf("The previous Image tag does not exist anymore in the repository and the local image %s is gone", imageNameAndTag)
+	}
+	var repoDigests []string
+	if err := json.Unmarshal(out, &repoDigests); err != nil {
+		return err
+	}
+	for _, repoDigest := range repoDigests {
+		if pushedDigest != "" && strings.HasSuffix(repoDigest, "@"+pushedDigest) {
+			return nil
+		}
+	}
+	return fmt.Errorf("The local image %s is not the pushed image %s, it is not pushed again", imageNameAndTag, pushedDigest)
+}
+
+// removeLocalImages removes the given references from the local image store.
+// Docker only deletes layers no other image uses, so base images stay intact.
+func removeLocalImages(opts awsCallOptions, imageRefs []string) error {
+	cmdArgs := append([]string{"image", "rm"}, imageRefs...)
+	removeImages := opts.toolCommand("docker", cmdArgs...)
+	out, err := removeImages.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	return nil
+}
+
+// removeStaleImage drops a local tag left from an earlier build after the
+// build for it failed, so a retry cannot take it for the result of this build.
+func removeStaleImage(opts awsCallOptions, imageNameAndTag string) {
+	if localImageExists(opts, imageNameAndTag) != true {
+		return
+	}
+	fmt.Println("Removing stale local image ", imageNameAndTag)
+	err := removeLocalImages(opts, []string{imageNameAndTag})
+	if err != nil {
+		log.Printf("[WARN] Error removing stale local image %s: %v", imageNameAndTag, err)
+	}
+}
+
+func tagDockerImage(opts awsCallOptions, imageNameAndTag, ecrUriWithTag string) error {
+	tagCmd := fmt.Sprintf("docker tag %s %s", imageNameAndTag, ecrUriWithTag)
+	tag := opts.toolCommand("bash", "-c", tagCmd)
+	out, err := tag.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	return nil
+}
+
+// pushDockerImage pushes the image and returns the manifest digest reported by docker push.
+func pushDockerImage(opts awsCallOptions, ecrUriWithTag, awsRegion, ecrUri, authMode string, buildLog io.Writer) (string, error) {
+	dockerPushCmd := fmt.Sprintf("docker push %s", ecrUriWithTag)
+	pushImage := opts.toolCommand("bash", "-c", dockerPushCmd)
+	var pushOutput bytes.Buffer
+	pushImage.Stdout = io.MultiWriter(os.Stdout, &pushOutput, buildLog)
+	pushImage.Stderr = io.MultiWriter(os.Stderr, buildLog)
+	if authMode == "credential_helper" {
+		// Docker resolves the credentials itself through the configured helper
+		err := credentialHelperConfigured(ecrUri, "")
+		if err != nil {
+			return "", err
+		}
+		err = pushImage.Run()
+		if err != nil {
+			fmt.Println(err)
+			return "", err
+		}
+		return parsePushedDigest(pushOutput.String()), nil
+	}
+	authenticateCommand := opts.toolCommand("bash", "-c", ecrLoginCommand(awsRegion, ecrUri, "docker login"))
+	var err error
+	pushImage.Stdin, err = authenticateCommand.StdoutPipe()
 	if err != nil {
-		log.Fatal(err)
-	}
-	if out != true {
-		log.Fatal("The provided ECR repository does not exist")
+		fmt.Println(pushImage.Stdin) 
+		return "", err
 	}
 
-	repoMutability, err := isMutable(repoName, awsRegion)
-	if err != nil {
-		log.Fatal(err)
+	errStart := pushImage.Start()
+	errRun := authenticateCommand.Run()
+	errWait := pushImage.Wait()
+	if errStart != nil {
+		fmt.Println(errStart)
+		return "", errStart
 	}
-	tagAlreadyExists, err := imageTagExist(imageTag, repoName, awsRegion) 
-	if err != nil {
-		log.Fatal(err)
+	if errRun != nil {
+		fmt.Println(errRun)
+		return "", errRun
+	}
+	if errWait != nil {
+		fmt.Println(errWait)
+		return "", errWait
 	}
+	return parsePushedDigest(pushOutput.String()), nil
+}
 
-	if tagAlreadyExists == true && repoMutability == false {
-		log.Fatal("The repo is immutable and you are trying to push an image with a tag that already exists in it")
+// dockerLoginCommand is the docker login for ecrLoginCommand, stored in the
+// docker_config_dir when one is set.
+func dockerLoginCommand(dockerConfigDir string) string {
+	if dockerConfigDir == "" {
+		return "docker login"
+	}
+	return fmt.Sprintf("docker --config '%s' login", strings.ReplaceAll(dockerConfigDir, "'", `'\''`))
+}
+
+// ecrLoginCommand pipes an ECR authorization token into the login command of
+// a registry client such as "docker login" or "helm registry login".
+func ecrLoginCommand(awsRegion, ecrUri, loginCommand string) string {
+	return "aws ecr get-login-password --region " + awsRegion + " | " + loginCommand + " --username AWS --password-stdin " + ecrUri
+}
+
+// replicationPollInterval is the time between two checks of a replica region.
+const replicationPollInterval = 10 * time.Second
+
+// waitForReplication polls the replica region until the digest shows up in
+// the repository of the same name. Replication creates the repository with
+// the first image, so a missing repository counts as not yet replicated.
+func waitForReplication(opts awsCallOptions, repoName, imageDigest, replicaRegion string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		describeImage, cancel := opts.command("aws", "ecr", "describe-images", "--repository-name", repoName, "--image-ids", "imageDigest="+imageDigest, "--query", "imageDetails[0].imageDigest", "--output", "text", "--region", replicaRegion)
+		out, err := describeImage.CombinedOutput()
+		cancel()
+		if err == nil && strings.TrimSpace(string(out)) == imageDigest {
+			return nil
+		}
+		if err != nil && strings.Contains(string(out), "ImageNotFoundException") != true && strings.Contains(string(out), "RepositoryNotFoundException") != true {
+			fmt.Println(string(out))
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not replicated to %s within %s", imageDigest, replicaRegion, timeout)
+		}
+		time.Sleep(replicationPollInterval)
 	}
+}
 
-	fmt.Println("Retrieving AWS account Id")
-	awsAccountId, err := getAWSAccountID()
+// pullCacheImage pulls the previously pushed image, the classic builder only
+// uses images from the local store as cache.
+func pullCacheImage(opts awsCallOptions, cacheUri, awsRegion, ecrUri, authMode, dockerConfigDir string) error {
+	if authMode != "credential_helper" {
+		login := opts.toolCommand("bash", "-c", ecrLoginCommand(awsRegion, ecrUri, dockerLoginCommand(dockerConfigDir)))
+		out, err := login.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	pullImage := opts.toolCommand("docker", append(dockerConfigArgs(dockerConfigDir), "pull", cacheUri)...)
+	out, err := pullImage.CombinedOutput()
 	if err != nil {
-		log.Fatal("Error retrieving AWS account Id: ", err)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
 	}
-	ecrUri := fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", awsAccountId, awsRegion)
-	ecrUriWithRepo := fmt.Sprintf("%s/%s", ecrUri, repoName)
-	ecrUriWithTag := fmt.Sprintf("%s:%s", ecrUriWithRepo, imageTag)
+	return nil
+}
 
-	fmt.Println("Building Docker image: ", imageName)
-	err = buildDockerImage(imageNameAndTag, dockerfilePath)
+// getDockerConfigJson builds a docker config with the credentials of an ECR
+// authorization token for the registry host. The token is valid for 12 hours,
+// it returns the expiry in RFC 3339.
+func getDockerConfigJson(opts awsCallOptions, registryHost, awsRegion string) (string, string, error) {
+	getToken, cancel := opts.command("aws", "ecr", "get-authorization-token", "--query", "authorizationData[0].{token: authorizationToken, expiresAt: expiresAt}", "--output", "json", "--region", awsRegion)
+	defer cancel()
+	out, err := getToken.CombinedOutput()
 	if err != nil {
-		log.Fatal("Error building Docker image: ", err)		
+		fmt.Println(string(out))
+		return "", "", err
+	}
+	var authorization struct {
+		Token     string      `json:"token"`
+		ExpiresAt interface{} `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(out, &authorization); err != nil {
+		return "", "", err
 	}
-	fmt.Println("Tagging Docker image")
-	err = tagDockerImage(imageNameAndTag, ecrUriWithTag)
+	// The token is the base64 of AWS:<password>, the same as the auth field
+	credentials, err := base64.StdEncoding.DecodeString(authorization.Token)
 	if err != nil {
-		log.Fatal("Error tagging Docker image: ", err)		
+		return "", "", err
 	}
-	fmt.Println("Pushing Docker image")
-	err = pushDockerImage(ecrUriWithTag, awsRegion, ecrUri)
+	username, password, found := strings.Cut(string(credentials), ":")
+	if found != true {
+		return "", "", errors.New("The ECR authorization token has an unexpected format")
+	}
+	dockerConfig := map[string]interface{}{
+		"auths": map[string]interface{}{
+			registryHost: map[string]string{
+				"username": username,
+				"password": password,
+				"auth":     authorization.Token,
+			},
+		},
+	}
+	dockerConfigJson, err := json.Marshal(dockerConfig)
 	if err != nil {
-		log.Fatal("Error pushing Docker image: ", err)		
+		return "", "", err
 	}
-	fmt.Println("Docker image successfully pushed to ECR")
-
-	return nil
+	return string(dockerConfigJson), parseCLITimestamp(authorization.ExpiresAt).UTC().Format(time.RFC3339), nil
 }
 
+var pushedDigestRegexp = regexp.MustCompile(`digest: (sha256:[a-f0-9]{64})`)
 
-func resourcePushImageDelete(d *schema.ResourceData, meta interface{}) error { 
-	
-	repoName := d.Get("ecr_repository_name").(string)
-	imageTag := d.Get("image_tag").(string)
-	awsRegion := d.Get("aws_-region").(string)
+var pushedLayerRegexp = regexp.MustCompile(`(?m)^([a-f0-9]+): (Pushed|Layer already exists|Mounted from \S+)\s*$`)
 
-	out, err := repoExists(repoName, awsRegion)
-	if err != nil {
-		log.Fatal(err)
+// countPushedLayers counts the layers docker push uploaded and the ones the
+// registry already had, including layers mounted from another repository.
+func countPushedLayers(pushOutput string) (int, int) {
+	layerStatus := map[string]string{}
+	for _, match := range pushedLayerRegexp.FindAllStringSubmatch(pushOutput, -1) {
+		layerStatus[match[1]] = match[2]
 	}
-	if out != true {
-		log.Fatal("The provided ECR repository does not exist")
+	pushed, reused := 0, 0
+	for _, status := range layerStatus {
+		if status == "Pushed" {
+			pushed++
+		} else {
+			reused++
+		}
+	}
+	return pushed, reused
+}
+
+func parsePushedDigest(pushOutput string) string {
+	match := pushedDigestRegexp.FindStringSubmatch(pushOutput)
+	if match == nil {
+		return ""
 	}
+	return match[1]
+}
 
-	out, err = imageTagExist(imageTag, repoName, awsRegion)
+// verifyPushedImage checks that the tag can be retrieved from ECR and resolves
+// to the digest docker push reported.
+func verifyPushedImage(opts awsCallOptions, repoName, imageTag, pushedDigest, awsRegion string) error {
+	tagExists, err := imageTagExist(opts, imageTag, repoName, awsRegion)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	if out != true {
-		log.Fatal("The provided Image tag does not exist in the repository")
+	if tagExists != true {
+		return fmt.Errorf("The pushed tag %s is not present in repository %s", imageTag, repoName)
+	}
+	if pushedDigest == "" {
+		return errors.New("docker push did not report the digest of the pushed image")
+	}
+	imageDigest, err := getImageDigest(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		return err
 	}
+	if imageDigest != pushedDigest {
+		return fmt.Errorf("Tag %s resolves to %s in ECR but docker push reported %s", imageTag, imageDigest, pushedDigest)
+	}
+	return nil
+}
 
-	fmt.Println("Deleting image")
-	err = deleteImage(repoName, imageTag, awsRegion)
+func credentialHelperConfigured(registryHost, dockerConfigDir string) error {
+	if dockerConfigDir == "" {
+		dockerConfigDir = os.Getenv("DOCKER_CONFIG")
+	}
+	if dockerConfigDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		dockerConfigDir = filepath.Join(homeDir, ".docker")
+	}
+	configPath := filepath.Join(dockerConfigDir, "config.json")
+	out, err := os.ReadFile(configPath)
 	if err != nil {
-		log.Fatal("Error deleting Image", err)
+		return fmt.Errorf("Error reading Docker config %s: %v", configPath, err)
 	}
-	fmt.Println("Docker image successfully removed from ECR")
+	var dockerConfig struct {
+		CredsStore  string            `json:"credsStore"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}
+	if err := json.Unmarshal(out, &dockerConfig); err != nil {
+		return err
+	}
+	if dockerConfig.CredHelpers[registryHost] == "" && dockerConfig.CredsStore == "" {
+		return fmt.Errorf("No credential helper is configured for %s in %s", registryHost, configPath)
+	}
+	return nil
+}
 
+func deleteImage(opts awsCallOptions, repoName, imageTag, awsRegion string) error {
+	deleteCommand := fmt.Sprintf("aws ecr batch-delete-image --repository-name %s --image-ids imageTag=%s --output text --region %s", repoName, imageTag, awsRegion)
+	deleteImage, cancel := opts.command("bash", "-c", deleteCommand)
+	defer cancel()
+	out, err := deleteImage.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
 	return nil
 }
 
-func resourcePushImageUpdate(d *schema.ResourceData, meta interface{}) error {
-	if d.HasChange("image_tag") {
-		repoName := d.Get("ecr_repository_name").(string)
-		oldVal, newVal := d.GetChange("image_tag")
-		oldTag := oldVal.(string)
-		newTag := newVal.(string)
-		awsRegion := d.Get("aws_region").(string)
+func deleteImageByDigest(opts awsCallOptions, repoName, imageDigest, awsRegion string) error {
+	deleteCommand := fmt.Sprintf("aws ecr batch-delete-image --repository-name %s --image-ids imageDigest=%s --output text --region %s", repoName, imageDigest, awsRegion)
+	deleteImage, cancel := opts.command("bash", "-c", deleteCommand)
+	defer cancel()
+	out, err := deleteImage.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	return nil
+}
 
-		out, err := repoExists(repoName, awsRegion)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if out != true {
-			log.Fatal("The provided ECR repository does not exist")
-		}
-	
-		out, err = imageTagExist(oldTag, repoName, awsRegion)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if out != true {
-			log.Fatal("The previous Image tag does not exist anymore in the repository")
-		}
-	
-		repoMutability, err := isMutable(repoName, awsRegion)
-		if err != nil {
-			log.Fatal(err)
-		}
-		newTagAlreadyExists, err := imageTagExist(newTag, repoName, awsRegion) 
-		if err != nil {
-			log.Fatal(err)
-		}
-	
-		if newTagAlreadyExists == true && repoMutability == false {
-			log.Fatal("The repositorie is immutable and you are trying to update an image with a tag that already exists in the repositorie")
+func repoExists(opts awsCallOptions, repoName, awsRegion string) (bool, error) {
+	describeReposCMD := fmt.Sprintf("aws ecr describe-repositories --query 'repositories[].repositoryName' --output json --region %s", awsRegion)
+	decribeRepos, cancel := opts.command("bash", "-c", describeReposCMD)
+	defer cancel()
+	out, err :=  decribeRepos.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return false, err
+	}
+	var repoNames []string
+	if err := json.Unmarshal(out, &repoNames); err != nil {
+		return false, err
+	}
+	for _, name := range repoNames {
+		if name == repoName {
+			return true, nil }
 		}
+	cachePrefix, err := pullThroughCachePrefix(opts, repoName, awsRegion)
+	if err != nil {
+		return false, err
+	}
+	if cachePrefix != "" {
+		return false, fmt.Errorf("Repository %s is managed by the pull through cache rule for prefix %s, pushing images to pull through cache repositories is not supported", repoName, cachePrefix)
+	}
+	return false, nil
+ }
 
-		imageManifest, err := getImageManifest(repoName, oldTag, awsRegion)
-		if err != nil {
-			log.Fatal("Error retriving Image digest", err)
-		}
-		err = updateImageTag(imageManifest, repoName, newTag, awsRegion)
-		if err != nil {
-			log.Fatal("Error updating Image Tag", err)
-		}
-		err = deleteImage(repoName, oldTag, awsRegion)
-		if err != nil {
-			log.Fatal("Error deleting the old image tag")
+func getEncryptionConfiguration(d resourceGetter) (string, string) {
+	encryptionConfigurations := d.Get("encryption_configuration").([]interface{})
+	if len(encryptionConfigurations) == 0 || encryptionConfigurations[0] == nil {
+		return "", ""
+	}
+	encryptionConfiguration := encryptionConfigurations[0].(map[string]interface{})
+	return encryptionConfiguration["encryption_type"].(string), encryptionConfiguration["kms_key"].(string)
+}
+
+func createRepository(opts awsCallOptions, repoName, tagMutability, encryptionType, kmsKey, awsRegion string) error {
+	cmdArgs := []string{"ecr", "create-repository", "--repository-name", repoName, "--image-tag-mutability", tagMutability, "--region", awsRegion}
+	if encryptionType != "" {
+		encryptionConfiguration := fmt.Sprintf("encryptionType=%s", encryptionType)
+		if kmsKey != "" {
+			encryptionConfiguration = fmt.Sprintf("%s,kmsKey=%s", encryptionConfiguration, kmsKey)
 		}
+		cmdArgs = append(cmdArgs, "--encryption-configuration", encryptionConfiguration)
+	}
+	createRepo, cancel := opts.command("aws", cmdArgs...)
+	defer cancel()
+	out, err := createRepo.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
 	}
 	return nil
 }
 
-func getImageManifest(repoName, imageTag, awsRegion string) (string, error) {
-
-	digestCMD := fmt.Sprintf("aws ecr batch-get-image --repository-name %s --image-ids imageTag=%s --query 'images[].imageManifest' --output text --region %s", repoName, imageTag, awsRegion)
-	digest := exec.Command("bash", "-c", digestCMD)
-	out, err := digest.CombinedOutput() 
+func isScanOnPushEnabled(opts awsCallOptions, repoName, awsRegion string) (bool, error) {
+	describeRepo, cancel := opts.command("aws", "ecr", "describe-repositories", "--repository-names", repoName, "--query", "repositories[0].imageScanningConfiguration.scanOnPush", "--output", "text", "--region", awsRegion)
+	defer cancel()
+	out, err := describeRepo.CombinedOutput()
 	if err != nil {
-		return "", err
+		fmt.Println(string(out))
+		return false, err
 	}
-	return string(out), nil
+	return strings.TrimSpace(string(out)) == "True", nil
 }
 
-func updateImageTag(imageManifest, repoName, newImageTag, awsRegion string) error {
-	updateTagCMD := fmt.Sprintf("aws ecr put-image --repository-name %s --image-tag %s --image-manifest '%s' --region %s", repoName, newImageTag, imageManifest, awsRegion)
-	updateTag := exec.Command("bash", "-c", updateTagCMD)
-	_, err := updateTag.CombinedOutput()
+func setRepositoryPolicy(opts awsCallOptions, repoName, repositoryPolicy, awsRegion string) error {
+	setPolicy, cancel := opts.command("aws", "ecr", "set-repository-policy", "--repository-name", repoName, "--policy-text", repositoryPolicy, "--region", awsRegion)
+	defer cancel()
+	out, err := setPolicy.CombinedOutput()
 	if err != nil {
+		fmt.Println(string(out))
 		return err
 	}
 	return nil
 }
 
-func getAWSAccountID() (string, error) {
-	getAccountIdCMD := exec.Command("aws", "sts", "get-caller-identity", "--query", "Account", "--output", "text")
-	accountId, err := getAccountIdCMD.CombinedOutput()
+// getRepositoryPolicy returns the policy text of the repository, or an empty
+// string when it has none.
+func getRepositoryPolicy(opts awsCallOptions, repoName, awsRegion string) (string, error) {
+	getPolicy, cancel := opts.command("aws", "ecr", "get-repository-policy", "--repository-name", repoName, "--query", "policyText", "--output", "text", "--region", awsRegion)
+	defer cancel()
+	out, err := getPolicy.CombinedOutput()
 	if err != nil {
+		if strings.Contains(string(out), "RepositoryPolicyNotFoundException") {
+			return "", nil
+		}
+		fmt.Println(string(out))
 		return "", err
 	}
-	accountIdTrimmed := strings.TrimSpace(string(accountId))
-	return accountIdTrimmed, nil
+	return strings.TrimSpace(string(out)), nil
 }
 
-func buildDockerImage(imageNameAndTag, dockerfilePath string) error {
-	dockerBuildImage := exec.Command("docker", "build", "-t", imageNameAndTag, dockerfilePath) 
-	out, err := dockerBuildImage.CombinedOutput()
-	if err != nil {
+func deleteRepositoryPolicy(opts awsCallOptions, repoName, awsRegion string) error {
+	deletePolicy, cancel := opts.command("aws", "ecr", "delete-repository-policy", "--repository-name", repoName, "--region", awsRegion)
+	defer cancel()
+	out, err := deletePolicy.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "RepositoryPolicyNotFoundException") != true {
 		fmt.Println(string(out))
 		return err
 	}
 	return nil
 }
 
-func tagDockerImage(imageNameAndTag, ecrUriWithTag string) error {
-	tagCmd := fmt.Sprintf("docker tag %s %s", imageNameAndTag, ecrUriWithTag)
-	tag := exec.Command("bash", "-c", tagCmd)
-	out, err := tag.CombinedOutput()
+func putLifecyclePolicy(opts awsCallOptions, repoName, lifecyclePolicy, awsRegion string) error {
+	putPolicy, cancel := opts.command("aws", "ecr", "put-lifecycle-policy", "--repository-name", repoName, "--lifecycle-policy-text", lifecyclePolicy, "--region", awsRegion)
+	defer cancel()
+	out, err := putPolicy.CombinedOutput()
 	if err != nil {
 		fmt.Println(string(out))
 		return err
@@ -242,40 +3402,52 @@ func tagDockerImage(imageNameAndTag, ecrUriWithTag string) error {
 	return nil
 }
 
-func pushDockerImage(ecrUriWithTag, awsRegion, ecrUri string) error {
-	dockerPushCmd := fmt.Sprintf("docker push %s", ecrUriWithTag)
-	pushImage := exec.Command("bash", "-c", dockerPushCmd)
-	authenticateCommand := exec.Command("bash", "-c", "aws ecr get-login-password --region " + awsRegion + " | docker login --username AWS --password-stdin " + ecrUri)
-	var err error
-	pushImage.Stdin, err = authenticateCommand.StdoutPipe()
+// getLifecyclePolicy returns the lifecycle policy text of the repository, or
+// an empty string when it has none.
+func getLifecyclePolicy(opts awsCallOptions, repoName, awsRegion string) (string, error) {
+	getPolicy, cancel := opts.command("aws", "ecr", "get-lifecycle-policy", "--repository-name", repoName, "--query", "lifecyclePolicyText", "--output", "text", "--region", awsRegion)
+	defer cancel()
+	out, err := getPolicy.CombinedOutput()
 	if err != nil {
-		fmt.Println(pushImage.Stdin) 
+		if strings.Contains(string(out), "LifecyclePolicyNotFoundException") {
+			return "", nil
+		}
+		fmt.Println(string(out))
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func deleteTagIfExists(opts awsCallOptions, repoName, imageTag, awsRegion string) error {
+	tagExists, err := imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil || tagExists != true {
 		return err
 	}
-	pushImage.Stdout = os.Stdout
+	return deleteImage(opts, repoName, imageTag, awsRegion)
+}
 
-	errStart := pushImage.Start()
-	errRun := authenticateCommand.Run()
-	errWait := pushImage.Wait()
-	if errStart != nil {
-		fmt.Println(errStart)
-		return errStart
+// deleteTagIfDigest deletes the tag only while it still points at the image
+// digest, a tag moved to another image is left in place.
+func deleteTagIfDigest(opts awsCallOptions, repoName, imageTag, imageDigest, awsRegion string) error {
+	tagExists, err := imageTagExist(opts, imageTag, repoName, awsRegion)
+	if err != nil || tagExists != true {
+		return err
 	}
-	if errRun != nil {
-		fmt.Println(errRun)
-		return errRun
+	tagDigest, err := getImageDigest(opts, repoName, imageTag, awsRegion)
+	if err != nil {
+		return err
 	}
-	if errWait != nil {
-		fmt.Println(errWait)
-		return errWait
+	if tagDigest != imageDigest {
+		log.Printf("[WARN] Tag %s now points at %s instead of %s, it is not deleted", imageTag, tagDigest, imageDigest)
+		return nil
 	}
-	return nil
+	return deleteImage(opts, repoName, imageTag, awsRegion)
 }
 
-func deleteImage(repoName, imageTag, awsRegion string) error {
-	deleteCommand := fmt.Sprintf("aws ecr batch-delete-image --repository-name %s --image-ids imageTag=%s --output text --region %s", repoName, imageTag, awsRegion)
-	deleteImage := exec.Command("bash", "-c", deleteCommand)
-	out, err := deleteImage.CombinedOutput()
+func deleteRepository(opts awsCallOptions, repoName, awsRegion string) error {
+	deleteRepo, cancel := opts.command("aws", "ecr", "delete-repository", "--repository-name", repoName, "--region", awsRegion)
+	defer cancel()
+	out, err := deleteRepo.CombinedOutput()
 	if err != nil {
 		fmt.Println(string(out))
 		return err
@@ -283,48 +3455,89 @@ func deleteImage(repoName, imageTag, awsRegion string) error {
 	return nil
 }
 
-func repoExists(repoName, awsRegion string) (bool, error) {
-	describeReposCMD := fmt.Sprintf("aws ecr describe-repositories --query 'repositories[].repositoryName' --output json --region %s", awsRegion)
-	decribeRepos := exec.Command("bash", "-c", describeReposCMD)
-	out, err :=  decribeRepos.CombinedOutput()
+// pullThroughCachePrefix returns the pull through cache rule prefix the
+// repository name falls under, or an empty string.
+func pullThroughCachePrefix(opts awsCallOptions, repoName, awsRegion string) (string, error) {
+	describeRulesCMD := fmt.Sprintf("aws ecr describe-pull-through-cache-rules --query 'pullThroughCacheRules[].ecrRepositoryPrefix' --output json --region %s", awsRegion)
+	describeRules, cancel := opts.command("bash", "-c", describeRulesCMD)
+	defer cancel()
+	out, err := describeRules.CombinedOutput()
 	if err != nil {
 		fmt.Println(string(out))
-		return false, err
+		return "", err
 	}
-	var repoNames []string
-	if err := json.Unmarshal(out, &repoNames); err != nil {
-		return false, err
+	var prefixes []string
+	if err := json.Unmarshal(out, &prefixes); err != nil {
+		return "", err
 	}
-	for _, name := range repoNames {
-		if name == repoName {
-			return true, nil }
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(repoName, prefix+"/") {
+			return prefix, nil
 		}
-	return false, errors.New("Repository does not exist")
- }
+	}
+	return "", nil
+}
+
+
+ // Tag status filters of ecr list-images
+const (
+	tagStatusTagged   = "TAGGED"
+	tagStatusUntagged = "UNTAGGED"
+	tagStatusAny      = "ANY"
+)
 
+type imageId struct {
+	ImageTag    string `json:"imageTag"`
+	ImageDigest string `json:"imageDigest"`
+}
 
- func imageTagExist(imageTag, repoName, awsRegion string) (bool, error) {
-	listImagesCMD := fmt.Sprintf("aws ecr list-images --repository-name %s --query 'imageIds[].imageTag' --output json --region %s", repoName, awsRegion)
-	listImages := exec.Command("bash", "-c", listImagesCMD)
+// listImageIds lists the images of the repository matching tagStatus, the
+// aws CLI follows the pagination of ListImages.
+func listImageIds(opts awsCallOptions, repoName, tagStatus, awsRegion string) ([]imageId, error) {
+	listImagesCMD := fmt.Sprintf("aws ecr list-images --repository-name %s --filter tagStatus=%s --query 'imageIds' --output json --region %s", repoName, tagStatus, awsRegion)
+	listImages, cancel := opts.command("bash", "-c", listImagesCMD)
+	defer cancel()
 	out, err := listImages.CombinedOutput()
 	if err != nil {
 		fmt.Println(string(out))
-		return false, err
+		return nil, err
 	}
-	var imageTags []string
-	if err := json.Unmarshal(out, &imageTags); err != nil {
+	var imageIds []imageId
+	if err := json.Unmarshal(out, &imageIds); err != nil {
+		return nil, err
+	}
+	return imageIds, nil
+}
+
+ func imageTagExist(opts awsCallOptions, imageTag, repoName, awsRegion string) (bool, error) {
+	imageIds, err := listImageIds(opts, repoName, tagStatusTagged, awsRegion)
+	if err != nil {
 		return false, err
 	}
-	for _, name := range imageTags {
-		if name == imageTag {
+	for _, id := range imageIds {
+		if id.ImageTag == imageTag {
 			return true, nil }
 		}
 	return false, nil
  }
 
- func isMutable(repoName, awsRegion string) (bool, error) {
+ func imageDigestExist(opts awsCallOptions, imageDigest, tagStatus, repoName, awsRegion string) (bool, error) {
+	imageIds, err := listImageIds(opts, repoName, tagStatus, awsRegion)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range imageIds {
+		if id.ImageDigest == imageDigest {
+			return true, nil
+		}
+	}
+	return false, nil
+ }
+
+ func isMutable(opts awsCallOptions, repoName, awsRegion string) (bool, error) {
 	tagMutabilityCMD := fmt.Sprintf("aws ecr describe-repositories --repository-names %s --query 'repositories[].imageTagMutability' --output json --region %s", repoName, awsRegion)
-	tagMutability := exec.Command("bash", "-c", tagMutabilityCMD)
+	tagMutability, cancel := opts.command("bash", "-c", tagMutabilityCMD)
+	defer cancel()
 	out, err := tagMutability.CombinedOutput()
 	if err != nil {
 		return false, err
@@ -334,9 +3547,53 @@ func repoExists(repoName, awsRegion string) (bool, error) {
 		return false, err
 	}
 	for _, value := range response {
-		if value == "IMMUTABLE" {
+		if value == "IMMUTABLE" || value == "IMMUTABLE_WITH_EXCLUSION" {
 			return false, nil
 		}
 	}
 	return true, nil
- }
\ No newline at end of file
+ }
+
+// isTagMutable reports whether imageTag may be overwritten in the repository,
+// taking the tag mutability exclusion filters of the repository into account.
+func isTagMutable(opts awsCallOptions, imageTag, repoName, awsRegion string) (bool, error) {
+	describeRepoCMD := fmt.Sprintf("aws ecr describe-repositories --repository-names %s --query 'repositories[0].{mutability: imageTagMutability, filters: imageTagMutabilityExclusionFilters[].filter}' --output json --region %s", repoName, awsRegion)
+	describeRepo, cancel := opts.command("bash", "-c", describeRepoCMD)
+	defer cancel()
+	out, err := describeRepo.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return false, err
+	}
+	var response struct {
+		Mutability string   `json:"mutability"`
+		Filters    []string `json:"filters"`
+	}
+	if err := json.Unmarshal(out, &response); err != nil {
+		return false, err
+	}
+	excluded := false
+	for _, filter := range response.Filters {
+		if matchTagFilter(filter, imageTag) {
+			excluded = true
+			break
+		}
+	}
+	switch response.Mutability {
+	case "IMMUTABLE":
+		return false, nil
+	case "IMMUTABLE_WITH_EXCLUSION":
+		return excluded, nil
+	case "MUTABLE_WITH_EXCLUSION":
+		return !excluded, nil
+	}
+	return true, nil
+}
+
+// matchTagFilter matches a tag against an ECR wildcard filter, where * stands
+// for any sequence of characters.
+func matchTagFilter(filter, imageTag string) bool {
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(filter), `\*`, ".*")
+	matched, err := regexp.MatchString("^"+pattern+"$", imageTag)
+	return err == nil && matched
+}
\ No newline at end of file
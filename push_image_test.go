@@ -0,0 +1,235 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCommand puts an executable shell script called name in front of PATH,
+// standing in for the aws or docker CLI for the rest of the test.
+func fakeCommand(t *testing.T, name, script string) {
+	t.Helper()
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestGetImageManifestEmptyManifest(t *testing.T) {
+	for name, manifest := range map[string]string{
+		"nil":   `null`,
+		"empty": `""`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fakeCommand(t, "aws", `echo '[{"tag": "v1", "mediaType": "application/vnd.docker.distribution.manifest.v2+json", "manifest": `+manifest+`}]'`)
+			imageManifest, err := getImageManifest(awsCallOptions{}, "service", "v1", "eu-west-1")
+			if err == nil {
+				t.Fatalf("expected an error, got the manifest %q", imageManifest)
+			}
+			if strings.Contains(err.Error(), "empty") != true {
+				t.Errorf("expected the empty manifest error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGetImageManifestMissingTag(t *testing.T) {
+	fakeCommand(t, "aws", `echo '[]'`)
+	if _, err := getImageManifest(awsCallOptions{}, "service", "v1", "eu-west-1"); err == nil {
+		t.Fatal("expected an error for a tag without image")
+	}
+}
+
+// fakeDocker keeps a single local image, present as long as imageFile exists.
+func fakeDocker(t *testing.T, imageNameAndTag string) {
+	t.Helper()
+	imageFile := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(imageFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, "docker", `
+if [ "$3" != "`+imageNameAndTag+`" ]; then exit 1; fi
+case "$1 $2" in
+"image inspect") test -f `+imageFile+` ;;
+"image rm") rm `+imageFile+` ;;
+*) exit 1 ;;
+esac
+`)
+}
+
+func TestRemoveStaleImage(t *testing.T) {
+	fakeDocker(t, "service:v1")
+	opts := awsCallOptions{}
+	if localImageExists(opts, "service:v1") != true {
+		t.Fatal("expected the image left from the earlier build")
+	}
+	removeStaleImage(opts, "service:v1")
+	if localImageExists(opts, "service:v1") {
+		t.Error("expected the failed build to leave no service:v1 behind")
+	}
+}
+
+func TestRemoveStaleImageWithoutImage(t *testing.T) {
+	fakeDocker(t, "service:v1")
+	opts := awsCallOptions{}
+	removeStaleImage(opts, "service:v2")
+	if localImageExists(opts, "service:v1") != true {
+		t.Error("expected other local images to be kept")
+	}
+}
+
+func TestRepositoryNameRegexp(t *testing.T) {
+	for repoName, valid := range map[string]bool{
+		"service":               true,
+		"team/service":          true,
+		"team/sub-team/service": true,
+		"team.a/service_b":      true,
+		"team//service":         false,
+		"/service":              false,
+		"team/":                 false,
+		"Team/service":          false,
+		"team/-service":         false,
+	} {
+		if repositoryNameRegexp.MatchString(repoName) != valid {
+			t.Errorf("%s: expected valid %v", repoName, valid)
+		}
+	}
+}
+
+func TestGetPushUriNamespacedRepository(t *testing.T) {
+	ecrUriWithRepo := "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/service"
+	for name, test := range map[string]struct {
+		uriTemplate      string
+		endpointOverride string
+		expected         string
+	}{
+		"repository uri": {
+			expected: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/service:v1",
+		},
+		"endpoint override": {
+			endpointOverride: "vpce.example.com",
+			expected:         "vpce.example.com/team/service:v1",
+		},
+		"uri template": {
+			uriTemplate: "registry.example.com/{region}/{repo}:{tag}",
+			expected:    "registry.example.com/eu-west-1/team/service:v1",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := ResourcePushImage().TestResourceData()
+			d.Set("registry_endpoint_override", test.endpointOverride)
+			config := &Config{uriTemplate: test.uriTemplate}
+			pushUri, err := getPushUri(d, config.defaultAWSCallOptions(), config, ecrUriWithRepo, "eu-west-1", "team/service", "v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pushUri != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, pushUri)
+			}
+		})
+	}
+}
+
+func TestUpdateImageTagPassesManifestAsIs(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	fakeCommand(t, "aws", `for arg in "$@"; do echo "$arg"; done > `+argsFile)
+	imageManifest := `{"annotations": {"org.example.note": "it's $(touch pwned)"}}`
+	if err := updateImageTag(awsCallOptions{}, imageManifest, "team/service", "v1", "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(args), "\n"+imageManifest+"\n") != true {
+		t.Errorf("expected the manifest as a single argument, got %s", args)
+	}
+}
+
+func TestMatchTagFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter   string
+		imageTag string
+		expected bool
+	}{
+		{"latest", "latest", true},
+		{"latest", "latest-1", false},
+		{"dev-*", "dev-123", true},
+		{"dev-*", "dev-", true},
+		{"dev-*", "prod-dev-1", false},
+		{"*-snapshot", "1.2.0-snapshot", true},
+		{"release.*", "release.1", true},
+		{"release.*", "releasex1", false},
+		{"v1.?", "v1.?", true},
+		{"v1.?", "v1.2", false},
+		{"*", "anything", true},
+	} {
+		if matched := matchTagFilter(test.filter, test.imageTag); matched != test.expected {
+			t.Errorf("%s against %s: expected %v, got %v", test.imageTag, test.filter, test.expected, matched)
+		}
+	}
+}
+
+func TestIsTagMutable(t *testing.T) {
+	for _, test := range []struct {
+		mutability string
+		imageTag   string
+		expected   bool
+	}{
+		{"MUTABLE", "dev-1", true},
+		{"IMMUTABLE", "dev-1", false},
+		{"IMMUTABLE_WITH_EXCLUSION", "dev-1", true},
+		{"IMMUTABLE_WITH_EXCLUSION", "v1.0", false},
+		{"MUTABLE_WITH_EXCLUSION", "dev-1", false},
+		{"MUTABLE_WITH_EXCLUSION", "v1.0", true},
+	} {
+		fakeCommand(t, "aws", `echo '{"mutability": "`+test.mutability+`", "filters": ["latest", "dev-*"]}'`)
+		mutable, err := isTagMutable(awsCallOptions{}, test.imageTag, "team/service", "eu-west-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mutable != test.expected {
+			t.Errorf("%s in a %s repository: expected mutable %v, got %v", test.imageTag, test.mutability, test.expected, mutable)
+		}
+	}
+}
+
+func TestCountPushedLayers(t *testing.T) {
+	for name, test := range map[string]struct {
+		pushOutput string
+		pushed     int
+		reused     int
+	}{
+		"new and existing layers": {
+			pushOutput: "The push refers to repository [123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/service]\n" +
+				"5f70bf18a086: Preparing\n" +
+				"a1b2c3d4e5f6: Preparing\n" +
+				"0123456789ab: Preparing\n" +
+				"5f70bf18a086: Layer already exists\n" +
+				"a1b2c3d4e5f6: Pushed\n" +
+				"0123456789ab: Mounted from team/base\n" +
+				"v1: digest: sha256:0000000000000000000000000000000000000000000000000000000000000000 size: 949\n",
+			pushed: 1,
+			reused: 2,
+		},
+		"progress lines of a layer count once": {
+			pushOutput: "a1b2c3d4e5f6: Pushing [=====>    ]  10MB/20MB\n" +
+				"a1b2c3d4e5f6: Pushed\n" +
+				"a1b2c3d4e5f6: Pushed\n",
+			pushed: 1,
+		},
+		"no layers": {
+			pushOutput: "Error response from daemon: unauthorized\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pushed, reused := countPushedLayers(test.pushOutput)
+			if pushed != test.pushed || reused != test.reused {
+				t.Errorf("expected %d pushed and %d reused, got %d and %d", test.pushed, test.reused, pushed, reused)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+)
+
+// ResourcePushImages builds and pushes several images in one apply, for
+// example all services of a monorepo. Entries push to the repository of the
+// resource unless they name their own. A change of any entry or build context
+// pushes all images again.
+func ResourcePushImages() *schema.Resource {
+	return &schema.Resource{
+		Create:        resourcePushImagesCreate,
+		Read:          resourcePushImagesRead,
+		Delete:        resourcePushImagesDelete,
+		CustomizeDiff: resourcePushImagesCustomizeDiff,
+		Schema: map[string]*schema.Schema{
+			"ecr_repository_name": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringMatch(repositoryNameRegexp, "must be a valid ECR repository name"),
+			},
+			"aws_region": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"AWS_REGION", "AWS_DEFAULT_REGION"}, nil),
+			},
+			"images": {
+				Type:     schema.TypeList,
+				Required: true,
+				ForceNew: true,
+				MinItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"image_name": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ForceNew:     true,
+							ValidateFunc: validateImageName,
+						},
+						"image_tag": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ForceNew:     true,
+							ValidateFunc: validateImageTag,
+						},
+						"dockerfile_path": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+							Default:  ".",
+						},
+						"context_path": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+						"ecr_repository_name": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							ValidateFunc: validation.StringMatch(repositoryNameRegexp, "must be a valid ECR repository name"),
+						},
+					},
+				},
+			},
+			"auth_mode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      "ecr_api",
+				ValidateFunc: validation.StringInSlice([]string{"ecr_api", "credential_helper"}, false),
+			},
+			"content_hash": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			// Digest of every pushed image by repository:tag
+			"image_digests": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+// batchImage is one entry of images with the defaults of the resource applied.
+type batchImage struct {
+	imageName   string
+	imageTag    string
+	repoName    string
+	contextPath string
+	dockerfile  string
+}
+
+func (image batchImage) reference() string {
+	return fmt.Sprintf("%s:%s", image.repoName, image.imageTag)
+}
+
+func getBatchImages(d resourceGetter) ([]batchImage, error) {
+	var images []batchImage
+	for i, raw := range d.Get("images").([]interface{}) {
+		entry := raw.(map[string]interface{})
+		image := batchImage{
+			imageName: entry["image_name"].(string),
+			imageTag:  entry["image_tag"].(string),
+			repoName:  entry["ecr_repository_name"].(string),
+		}
+		if image.repoName == "" {
+			image.repoName = d.Get("ecr_repository_name").(string)
+		}
+		if image.repoName == "" {
+			return nil, fmt.Errorf("images[%d] %s: set ecr_repository_name on the entry or the resource", i, image.imageName)
+		}
+		// Same meaning as dockerfile_path and context_path of aws_ecr_push_image
+		dockerfilePath := entry["dockerfile_path"].(string)
+		image.contextPath = entry["context_path"].(string)
+		if image.contextPath == "" {
+			image.contextPath = dockerfilePath
+		} else {
+			if dockerfilePath == "." {
+				dockerfilePath = "Dockerfile"
+			}
+			image.dockerfile = filepath.Join(image.contextPath, dockerfilePath)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func resourcePushImagesCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	images, err := getBatchImages(d)
+	if err != nil {
+		return err
+	}
+	contentHash, err := getBatchContentHash(images)
+	if err != nil {
+		return fmt.Errorf("Error calculating content hash: %v", err)
+	}
+	if contentHash != d.Get("content_hash").(string) {
+		if err := d.SetNew("content_hash", contentHash); err != nil {
+			return err
+		}
+		if d.Id() != "" {
+			return d.ForceNew("content_hash")
+		}
+	}
+	return nil
+}
+
+func getBatchContentHash(images []batchImage) (string, error) {
+	contentHash := sha256.New()
+	for _, image := range images {
+		fmt.Fprintf(contentHash, "image %s %s\n", image.imageName, image.reference())
+		err := hashBuildContext(contentHash, image.contextPath, nil, nil, "")
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", image.reference(), err)
+		}
+		if image.dockerfile != "" {
+			fileHash, err := hashFile(image.dockerfile)
+			if err != nil {
+				return "", fmt.Errorf("%s: %v", image.reference(), err)
+			}
+			fmt.Fprintf(contentHash, "dockerfile %s\n", fileHash)
+		}
+	}
+	return hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+func resourcePushImagesCreate(d *schema.ResourceData, meta interface{}) error {
+	config := meta.(*Config)
+	opts := config.defaultAWSCallOptions()
+	awsRegion := d.Get("aws_region").(string)
+	images, err := getBatchImages(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	contentHash, err := getBatchContentHash(images)
+	if err != nil {
+		log.Fatal("Error calculating content hash: ", err)
+	}
+
+	if err := checkExpectedAccount(opts, awsRegion, config); err != nil {
+		return err
+	}
+	// Every entry is checked before the first build, so a conflict pushes nothing
+	for i, image := range images {
+		out, err := repoExists(opts, image.repoName, awsRegion)
+		if err != nil {
+			return fmt.Errorf("Error checking images[%d] %s: %v", i, image.reference(), err)
+		}
+		if out != true {
+			return fmt.Errorf("Error checking images[%d] %s: The ECR repository %s does not exist", i, image.reference(), image.repoName)
+		}
+		if _, err := checkImmutableTag(opts, image.repoName, image.imageTag, awsRegion); err != nil {
+			return fmt.Errorf("Error checking images[%d] %s: %v", i, image.reference(), err)
+		}
+	}
+
+	// The images pushed so far are kept in the state when an entry fails, the
+	// resource is then tainted and its delete removes them
+	d.SetId(fmt.Sprintf("%s/%s", awsRegion, contentHash))
+	d.Set("content_hash", contentHash)
+	imageDigests := map[string]string{}
+	for i, image := range images {
+		imageDigest, err := pushBatchImage(opts, config, image, d.Get("auth_mode").(string), awsRegion)
+		if err != nil {
+			d.Set("image_digests", imageDigests)
+			return fmt.Errorf("Error pushing images[%d] %s: %v", i, image.reference(), err)
+		}
+		imageDigests[image.reference()] = imageDigest
+	}
+	d.Set("image_digests", imageDigests)
+	return nil
+}
+
+func pushBatchImage(opts awsCallOptions, config *Config, image batchImage, authMode, awsRegion string) (string, error) {
+	ecrUri, ecrUriWithRepo, err := resolveRepositoryUri(opts, image.repoName, awsRegion, config)
+	if err != nil {
+		return "", err
+	}
+	imageNameAndTag := fmt.Sprintf("%s:%s", image.imageName, image.imageTag)
+	ecrUriWithTag := fmt.Sprintf("%s:%s", ecrUriWithRepo, image.imageTag)
+	fmt.Println("Building Docker image: ", image.imageName)
+	err = buildDockerImage(opts, imageNameAndTag, image.contextPath, image.dockerfile, "", "", nil, io.Discard)
+	if err != nil {
+		return "", err
+	}
+	err = tagDockerImage(opts, imageNameAndTag, ecrUriWithTag)
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Pushing Docker image: ", ecrUriWithTag)
+	config.acquirePush()
+	_, err = pushDockerImage(opts, ecrUriWithTag, awsRegion, ecrUri, authMode, io.Discard)
+	config.releasePush()
+	if err != nil {
+		return "", err
+	}
+	return getImageDigest(opts, image.repoName, image.imageTag, awsRegion)
+}
+
+// resourcePushImagesRead refreshes image_digests. A tag gone from ECR removes
+// the resource from the state, so the next apply pushes the whole batch again.
+func resourcePushImagesRead(d *schema.ResourceData, meta interface{}) error {
+	opts := meta.(*Config).defaultAWSCallOptions()
+	awsRegion := d.Get("aws_region").(string)
+	images, err := getBatchImages(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pushedDigests := d.Get("image_digests").(map[string]interface{})
+	imageDigests := map[string]string{}
+	for _, image := range images {
+		// Not pushed by a create that failed part way
+		if _, pushed := pushedDigests[image.reference()]; pushed != true {
+			continue
+		}
+		tagExists, err := imageTagExist(opts, image.imageTag, image.repoName, awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tagExists != true {
+			log.Printf("[WARN] Image %s is no longer in ECR", image.reference())
+			d.SetId("")
+			return nil
+		}
+		imageDigests[image.reference()], err = getImageDigest(opts, image.repoName, image.imageTag, awsRegion)
+		if err != nil {
+			log.Fatal("Error retrieving Image digest: ", err)
+		}
+	}
+	d.Set("image_digests", imageDigests)
+	return nil
+}
+
+func resourcePushImagesDelete(d *schema.ResourceData, meta interface{}) error {
+	opts := meta.(*Config).defaultAWSCallOptions()
+	awsRegion := d.Get("aws_region").(string)
+	images, err := getBatchImages(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imageDigests := d.Get("image_digests").(map[string]interface{})
+	for i, image := range images {
+		// Entries a failed create never pushed are left alone
+		imageDigest, pushed := imageDigests[image.reference()].(string)
+		if pushed != true {
+			continue
+		}
+		err := deleteTagIfDigest(opts, image.repoName, image.imageTag, imageDigest, awsRegion)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error deleting images[%d] %s: ", i, image.reference()), err)
+		}
+	}
+	return nil
+}
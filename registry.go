@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+// pushResourceImage pushes a tagged image to the registry of the resource,
+// the ECR registry or the registry_host with its own credentials.
+func pushResourceImage(opts awsCallOptions, d *schema.ResourceData, uriWithTag, awsRegion, ecrUri string, buildLog io.Writer) (string, error) {
+	if registryHost := d.Get("registry_host").(string); registryHost != "" {
+		if d.Get("insecure_skip_verify").(bool) {
+			log.Printf("[WARN] Pushing to %s without TLS verification", registryHost)
+			if err := checkInsecureRegistry(opts, registryHost); err != nil {
+				return "", err
+			}
+		}
+		return pushToRegistry(opts, uriWithTag, registryHost, d.Get("registry_username").(string), d.Get("registry_password").(string), buildLog)
+	}
+	return pushDockerImage(opts, uriWithTag, awsRegion, ecrUri, d.Get("auth_mode").(string), buildLog)
+}
+
+// loginResourceRegistry logs docker in to the registry of the resource for
+// builds that push themselves instead of going through pushResourceImage. The
+// login is stored in the docker_config_dir the build runs with.
+func loginResourceRegistry(opts awsCallOptions, d *schema.ResourceData, awsRegion, ecrUri string) error {
+	dockerConfigDir := d.Get("docker_config_dir").(string)
+	if registryHost := d.Get("registry_host").(string); registryHost != "" {
+		if d.Get("insecure_skip_verify").(bool) {
+			log.Printf("[WARN] Pushing to %s without TLS verification", registryHost)
+			if err := checkInsecureRegistry(opts, registryHost); err != nil {
+				return err
+			}
+		}
+		return registryLogin(opts, registryHost, d.Get("registry_username").(string), d.Get("registry_password").(string), dockerConfigDir)
+	}
+	if d.Get("auth_mode").(string) == "credential_helper" {
+		return credentialHelperConfigured(ecrUri, dockerConfigDir)
+	}
+	login := opts.toolCommand("bash", "-c", ecrLoginCommand(awsRegion, ecrUri, dockerLoginCommand(dockerConfigDir)))
+	out, err := login.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error logging in to %s: %v: %s", ecrUri, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// registryLogin logs in to a registry other than ECR. Without a username the
+// credentials docker already has for the host are used.
+func registryLogin(opts awsCallOptions, registryHost, username, password, dockerConfigDir string) error {
+	if username == "" {
+		return nil
+	}
+	login := opts.toolCommand("docker", append(dockerConfigArgs(dockerConfigDir), "login", registryHost, "--username", username, "--password-stdin")...)
+	login.Stdin = strings.NewReader(password)
+	out, err := login.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error logging in to %s: %v: %s", registryHost, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// pushToRegistry pushes to a registry other than ECR.
+func pushToRegistry(opts awsCallOptions, uriWithTag, registryHost, username, password string, buildLog io.Writer) (string, error) {
+	if err := registryLogin(opts, registryHost, username, password, ""); err != nil {
+		return "", err
+	}
+	pushImage := opts.toolCommand("docker", "push", uriWithTag)
+	var pushOutput bytes.Buffer
+	pushImage.Stdout = io.MultiWriter(os.Stdout, &pushOutput, buildLog)
+	pushImage.Stderr = io.MultiWriter(os.Stderr, buildLog)
+	err := pushImage.Run()
+	if err != nil {
+		return "", err
+	}
+	return parsePushedDigest(pushOutput.String()), nil
+}
+
+// readRegistryImage keeps the state of images in a registry_host, which has
+// no API the provider can query. Only the derived attributes are set.
+func readRegistryImage(d *schema.ResourceData) error {
+	registryHost := d.Get("registry_host").(string)
+	d.Set("image_digest", d.Get("last_pushed_digest").(string))
+	d.Set("short_digest", getShortDigest(d.Get("last_pushed_digest").(string)))
+	d.Set("registry_url", registryHost)
+	d.Set("image_uri", fmt.Sprintf("%s/%s:%s", registryHost, d.Get("ecr_repository_name").(string), getEffectiveTag(d)))
+	return nil
+}
+
+// updateRegistryImageTag pushes the local image under the new tag, the old
+// tag is left in the registry.
+func updateRegistryImageTag(d *schema.ResourceData, meta interface{}) error {
+	registryHost := d.Get("registry_host").(string)
+	opts := getAWSCallOptions(d, meta.(*Config))
+	oldVal, newVal := d.GetChange("image_tag")
+	localImage := fmt.Sprintf("%s:%s", getImageName(d), oldVal.(string))
+	if localImageExists(opts, localImage) != true {
+		log.Fatal("The local image ", localImage, " is needed to push the new tag to ", registryHost)
+	}
+	uriWithTag := fmt.Sprintf("%s/%s:%s", registryHost, d.Get("ecr_repository_name").(string), newVal.(string))
+	err := tagDockerImage(opts, localImage, uriWithTag)
+	if err != nil {
+		log.Fatal("Error tagging Docker image: ", err)
+	}
+	buildLog, closeBuildLog, err := openBuildLog(d)
+	if err != nil {
+		log.Fatal("Error opening build log: ", err)
+	}
+	defer closeBuildLog()
+	config := meta.(*Config)
+	config.acquirePush()
+	pushedDigest, err := pushResourceImage(opts, d, uriWithTag, "", "", buildLog)
+	config.releasePush()
+	if err != nil {
+		log.Fatal("Error pushing Docker image: ", err)
+	}
+	d.Set("effective_tag", newVal.(string))
+	d.Set("last_pushed_digest", pushedDigest)
+	return readRegistryImage(d)
+}
+
+var ecrHostRegexp = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?(:[0-9]+)?$`)
+
+func isECRHost(registryHost string) bool {
+	return ecrHostRegexp.MatchString(registryHost) || strings.HasSuffix(strings.Split(registryHost, ":")[0], ".amazonaws.com")
+}
+
+// checkInsecureRegistry makes sure the Docker daemon skips the TLS
+// verification for the host. Pushes are made by the daemon, which only does
+// so for loopback addresses and the insecure-registries of its daemon.json.
+func checkInsecureRegistry(opts awsCallOptions, registryHost string) error {
+	host := registryHost
+	if splitHost, _, err := net.SplitHostPort(registryHost); err == nil {
+		host = splitHost
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	dockerInfo := opts.toolCommand("docker", "info", "--format", "{{json .RegistryConfig}}")
+	out, err := dockerInfo.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error reading the registry configuration of the Docker daemon: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	var registryConfig struct {
+		InsecureRegistryCIDRs []string `json:"InsecureRegistryCIDRs"`
+		IndexConfigs          map[string]struct {
+			Secure bool `json:"Secure"`
+		} `json:"IndexConfigs"`
+	}
+	if err := json.Unmarshal(out, &registryConfig); err != nil {
+		return err
+	}
+	if indexConfig, found := registryConfig.IndexConfigs[registryHost]; found && indexConfig.Secure != true {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, cidr := range registryConfig.InsecureRegistryCIDRs {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("The Docker daemon verifies TLS for %s, add it to insecure-registries in its daemon.json to push without verification", registryHost)
+}
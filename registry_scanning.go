@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+// DataSourceRegistryScanningConfiguration reports the registry level scanning
+// of the account. With enhanced scanning the rules decide which repositories
+// are scanned, scan_on_push of a repository only applies to basic scanning.
+func DataSourceRegistryScanningConfiguration() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceRegistryScanningConfigurationRead,
+		Schema: map[string]*schema.Schema{
+			"aws_region": {
+				Type:        schema.TypeString,
+				Required:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"AWS_REGION", "AWS_DEFAULT_REGION"}, nil),
+			},
+			"scan_type": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"enhanced_scanning_enabled": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			"rules": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"scan_frequency": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						// Wildcard filters on the repository name
+						"repository_filters": {
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+type registryScanningConfiguration struct {
+	RegistryId string `json:"registryId"`
+	ScanType   string `json:"scanType"`
+	Rules      []struct {
+		ScanFrequency     string `json:"scanFrequency"`
+		RepositoryFilters []struct {
+			Filter string `json:"filter"`
+		} `json:"repositoryFilters"`
+	} `json:"rules"`
+}
+
+func dataSourceRegistryScanningConfigurationRead(d *schema.ResourceData, meta interface{}) error {
+	opts := meta.(*Config).defaultAWSCallOptions()
+	awsRegion := d.Get("aws_region").(string)
+
+	configuration, err := getRegistryScanningConfiguration(opts, awsRegion)
+	if err != nil {
+		log.Fatal("Error retrieving registry scanning configuration: ", err)
+	}
+	rules := []map[string]interface{}{}
+	for _, rule := range configuration.Rules {
+		filters := []string{}
+		for _, filter := range rule.RepositoryFilters {
+			filters = append(filters, filter.Filter)
+		}
+		rules = append(rules, map[string]interface{}{
+			"scan_frequency":     rule.ScanFrequency,
+			"repository_filters": filters,
+		})
+	}
+	d.SetId(fmt.Sprintf("%s/%s", awsRegion, configuration.RegistryId))
+	d.Set("scan_type", configuration.ScanType)
+	d.Set("enhanced_scanning_enabled", configuration.ScanType == "ENHANCED")
+	d.Set("rules", rules)
+	return nil
+}
+
+func getRegistryScanningConfiguration(opts awsCallOptions, awsRegion string) (*registryScanningConfiguration, error) {
+	getConfiguration, cancel := opts.command("aws", "ecr", "get-registry-scanning-configuration", "--query", "{registryId: registryId, scanType: scanningConfiguration.scanType, rules: scanningConfiguration.rules}", "--output", "json", "--region", awsRegion)
+	defer cancel()
+	out, err := getConfiguration.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return nil, err
+	}
+	configuration := &registryScanningConfiguration{}
+	if err := json.Unmarshal(out, configuration); err != nil {
+		return nil, err
+	}
+	return configuration, nil
+}